@@ -0,0 +1,151 @@
+package authutil
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/shusson/mapd-api/sqlutil"
+	"github.com/shusson/mapd-api/thrift/e745367/mapd"
+	"github.com/shusson/mapd-api/thriftutil"
+)
+
+const (
+	// KeyHeader the header a client sends its api key in
+	KeyHeader = "X-API-Key"
+	// KeyParam the query parameter a client sends its api key in when it can not set headers
+	KeyParam = "api_key"
+)
+
+// Principal an authenticated caller and what it may do. Empty lists permit everything.
+type Principal struct {
+	// Name identifies the caller in logs and rate limits, never the credential itself
+	Name string `json:"name"`
+	// Source how the caller authenticated, api-key or jwt
+	Source string `json:"-"`
+	// User the mapd-core user calls are made as instead of the shared session's user, if not empty
+	User string `json:"user,omitempty"`
+	// Databases the databases the caller may use
+	Databases []string `json:"databases,omitempty"`
+	// Methods the thrift methods the caller may call
+	Methods []string `json:"methods,omitempty"`
+	// Tables the tables the caller may query or change
+	Tables []string `json:"tables,omitempty"`
+	// RowFilters predicates by table that restrict the rows of the table the caller can read
+	RowFilters map[string]string `json:"row_filters,omitempty"`
+	// RateLimit requests per second, 0 is the proxy's default. Burst requests may be made at once, RateLimit rounded
+	// up if 0.
+	RateLimit float64 `json:"rate_limit,omitempty"`
+	Burst     int     `json:"burst,omitempty"`
+	// MaxConcurrent calls the caller may have running on mapd-core at once, 0 is the proxy's default
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+}
+
+// Restricted whether the principal may not make every call, calls that can not be checked are then rejected. A nil
+// principal is not restricted.
+func (p *Principal) Restricted() bool {
+	return p != nil && (p.User != "" || len(p.Databases) > 0 || len(p.Methods) > 0 || len(p.Tables) > 0 || len(p.RowFilters) > 0)
+}
+
+// Authorize whether the principal may make the call on db, an error with a message for the client if it may not.
+// A nil principal may make every call.
+func (p *Principal) Authorize(req *thriftutil.Request, db string) error {
+	if p == nil {
+		return nil
+	}
+	if !permits(p.Methods, req.Method, false) {
+		return fmt.Errorf("%s is not permitted for %s", req.Method, p.Name)
+	}
+	if args, ok := req.Args.(*mapd.MapDConnectArgs); ok {
+		if p.User != "" && args.User != p.User {
+			return fmt.Errorf("%s may only connect as %s", p.Name, p.User)
+		}
+		db = args.Dbname
+	}
+	if !permits(p.Databases, db, true) {
+		return fmt.Errorf("database %s is not permitted for %s", db, p.Name)
+	}
+	if len(p.Tables) == 0 {
+		return nil
+	}
+	tables, err := requestTables(req)
+	if err != nil {
+		return fmt.Errorf("%s is not permitted for %s, %s", req.Method, p.Name, err.Error())
+	}
+	for _, table := range tables {
+		if !permits(p.Tables, table, true) {
+			return fmt.Errorf("table %s is not permitted for %s", table, p.Name)
+		}
+	}
+	return nil
+}
+
+// untracedTables methods that read or write tables without naming them or with sql the proxy can not parse
+var untracedTables = map[string]bool{
+	"start_query": true, "execute_first_step": true, "broadcast_serialized_rows": true, "insert_data": true,
+}
+
+// requestTables every table a call references: the tables of its sql and of the sql of its vega spec, and the
+// tables it names. An error if it may reference tables that can not be told.
+func requestTables(req *thriftutil.Request) ([]string, error) {
+	if untracedTables[req.Method] {
+		return nil, errors.New("the tables it uses can not be told")
+	}
+	queries, err := req.VegaQueries()
+	if err != nil {
+		return nil, err
+	}
+	if query := req.Query(); query != "" {
+		queries = append(queries, query)
+	}
+	var tables []string
+	for _, query := range queries {
+		refs, ok := sqlutil.CheckedTables(query)
+		if !ok {
+			return nil, errors.New("the tables of its sql can not be told")
+		}
+		tables = append(tables, refs...)
+	}
+	if name := req.TableName(); name != "" {
+		tables = append(tables, name)
+	}
+	for name := range req.TableColNames() {
+		tables = append(tables, name)
+	}
+	return tables, nil
+}
+
+// permits whether the list is empty or holds the value, names of databases and tables ignore case
+func permits(list []string, value string, ignoreCase bool) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if v == value || ignoreCase && strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestKey the api key a request carries in the X-API-Key header or the api_key query parameter, empty if none
+func RequestKey(r *http.Request) string {
+	if key := r.Header.Get(KeyHeader); key != "" {
+		return key
+	}
+	return r.URL.Query().Get(KeyParam)
+}
+
+// StripCredentials remove the credentials from a request so that they are not forwarded to mapd-core
+func StripCredentials(r *http.Request) {
+	r.Header.Del(KeyHeader)
+	if RequestToken(r) != "" {
+		r.Header.Del("Authorization")
+	}
+	if q := r.URL.Query(); q.Get(KeyParam) != "" || q.Get(TokenParam) != "" {
+		q.Del(KeyParam)
+		q.Del(TokenParam)
+		r.URL.RawQuery = q.Encode()
+	}
+}
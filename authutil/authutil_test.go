@@ -0,0 +1,55 @@
+package authutil
+
+import (
+	"testing"
+
+	"github.com/shusson/mapd-api/thrift/e745367/mapd"
+	"github.com/shusson/mapd-api/thriftutil"
+)
+
+func TestAuthorizeTables(t *testing.T) {
+	p := &Principal{Name: "alice", Tables: []string{"pub"}}
+	sql := func(query string) *thriftutil.Request {
+		return &thriftutil.Request{Method: "sql_execute", Args: &mapd.MapDSqlExecuteArgs{Query: query}}
+	}
+	vega := func(spec string) *thriftutil.Request {
+		return &thriftutil.Request{Method: "render_vega", Args: &mapd.MapDRenderVegaArgs{VegaJSON: spec}}
+	}
+	tests := []struct {
+		name    string
+		req     *thriftutil.Request
+		allowed bool
+	}{
+		{"granted table", sql("SELECT * FROM pub"), true},
+		{"granted table in a subquery", sql("SELECT * FROM pub WHERE x IN (SELECT x FROM Pub)"), true},
+		{"table after a derived table", sql("SELECT * FROM (SELECT 1) x, secret"), false},
+		{"table in a subquery", sql("SELECT * FROM pub WHERE x IN (SELECT x FROM secret)"), false},
+		{"explicit table in IN", sql("SELECT * FROM pub WHERE x IN (TABLE secret)"), false},
+		{"explicit table in EXISTS", sql("SELECT * FROM pub WHERE EXISTS (TABLE secret)"), false},
+		{"explicit table in FROM", sql("SELECT * FROM (TABLE secret)"), false},
+		{"explicit granted table", sql("SELECT * FROM pub WHERE EXISTS (TABLE pub)"), true},
+		{"unicode name", sql(`SELECT * FROM U&"secre\0074"`), false},
+		{"unicode name in a subquery", sql(`SELECT * FROM pub WHERE x IN (TABLE U&"secre\0074")`), false},
+		{"unicode granted name", sql(`SELECT * FROM U&"\0070ub"`), true},
+		{"table function", sql("SELECT * FROM unnest(x)"), false},
+		{"vega sql", vega(`{"data":[{"name":"a","sql":"SELECT * FROM secret"}]}`), false},
+		{"granted vega sql", vega(`{"data":[{"name":"a","sql":"SELECT * FROM pub"}]}`), true},
+		{
+			"pixel lookup",
+			&thriftutil.Request{Method: "get_result_row_for_pixel", Args: &mapd.MapDGetResultRowForPixelArgs{
+				TableColNames: map[string][]string{"secret": {"x"}},
+			}},
+			false,
+		},
+		{"untraced method", &thriftutil.Request{Method: "insert_data", Args: &mapd.MapDInsertDataArgs{}}, false},
+	}
+	for _, test := range tests {
+		err := p.Authorize(test.req, "mapd")
+		if test.allowed && err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if !test.allowed && err == nil {
+			t.Errorf("%s: authorized, want an error", test.name)
+		}
+	}
+}
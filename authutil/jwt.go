@@ -0,0 +1,339 @@
+package authutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// TokenParam the query parameter a client sends its bearer token in when it can not set headers
+const TokenParam = "access_token"
+
+// Principal fields a claim can be mapped to with Verifier.Claims
+const (
+	NameClaim      = "name"
+	DatabasesClaim = "databases"
+	MethodsClaim   = "methods"
+	TablesClaim    = "tables"
+	UserClaim      = "user"
+)
+
+// DefaultClaims the claim each principal field is read from unless mapped to another claim
+var DefaultClaims = map[string]string{
+	NameClaim:      "sub",
+	DatabasesClaim: "databases",
+	MethodsClaim:   "methods",
+	TablesClaim:    "tables",
+	UserClaim:      "mapd_user",
+}
+
+// verificationKey a key tokens may be signed with, alg if not empty is the only algorithm it may be used with
+type verificationKey struct {
+	id  string
+	alg string
+	key interface{}
+}
+
+// Verifier validates json web tokens against keys read from local files, so that no identity provider has to be
+// reachable to verify them
+type Verifier struct {
+	keys []verificationKey
+	// Audience every token must be issued for, Issuer if not empty the issuer every token must come from
+	Audience string
+	Issuer   string
+	// Leeway allowed for clock skew when checking exp and nbf
+	Leeway time.Duration
+	// Claims the claim each principal field is read from by field, DefaultClaims for fields that are not mapped
+	Claims map[string]string
+	// RowFilters row filter templates by table, each {claim} in a template is replaced with the value of the claim.
+	// A token without a claim a template needs is rejected.
+	RowFilters map[string]string
+}
+
+// NewVerifier read the keys tokens are verified against from json web key sets and pem files of rsa or ecdsa
+// public keys or certificates
+func NewVerifier(jwksFiles []string, pemFiles []string) (*Verifier, error) {
+	v := &Verifier{}
+	for _, name := range jwksFiles {
+		keys, err := readJWKS(name)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = append(v.keys, keys...)
+	}
+	for _, name := range pemFiles {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var key interface{}
+		if key, err = jwt.ParseRSAPublicKeyFromPEM(b); err != nil {
+			if key, err = jwt.ParseECPublicKeyFromPEM(b); err != nil {
+				return nil, fmt.Errorf("%s: expected a pem rsa or ecdsa public key or certificate", name)
+			}
+		}
+		v.keys = append(v.keys, verificationKey{key: key})
+	}
+	if len(v.keys) == 0 {
+		return nil, errors.New("no keys to verify tokens with")
+	}
+	return v, nil
+}
+
+// RequestToken the bearer token a request carries in the Authorization header or the access_token query parameter,
+// empty if none
+func RequestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return r.URL.Query().Get(TokenParam)
+}
+
+// Verify check the signature, expiry, audience and issuer of a token and map its claims to a principal
+func (v *Verifier) Verify(token string) (*Principal, error) {
+	t, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %s", err.Error())
+	}
+	kid, _ := t.Header["kid"].(string)
+	keys := v.candidates(kid)
+	if len(keys) == 0 {
+		return nil, errors.New("invalid token: unknown signing key")
+	}
+	var claims jwt.MapClaims
+	for _, key := range keys {
+		claims = jwt.MapClaims{}
+		parser := &jwt.Parser{SkipClaimsValidation: true}
+		if _, err = parser.ParseWithClaims(token, claims, key.keyFunc); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %s", err.Error())
+	}
+	if err := v.validate(claims, time.Now()); err != nil {
+		return nil, fmt.Errorf("invalid token: %s", err.Error())
+	}
+	return v.principal(claims)
+}
+
+// candidates the keys a token with the kid may be signed with: the key with that id if there is one, every key
+// without an id otherwise and every key if the token has no kid
+func (v *Verifier) candidates(kid string) []verificationKey {
+	var keys []verificationKey
+	for _, key := range v.keys {
+		if kid != "" && key.id == kid {
+			return []verificationKey{key}
+		}
+		if kid == "" || key.id == "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// keyFunc the key to check the signature with, only if the token's algorithm is one the key is meant for so that
+// for example a public rsa key can not be passed off as an hmac secret
+func (k verificationKey) keyFunc(t *jwt.Token) (interface{}, error) {
+	if k.alg != "" && t.Method.Alg() != k.alg {
+		return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+	}
+	ok := false
+	switch k.key.(type) {
+	case *rsa.PublicKey:
+		_, rs := t.Method.(*jwt.SigningMethodRSA)
+		_, ps := t.Method.(*jwt.SigningMethodRSAPSS)
+		ok = rs || ps
+	case *ecdsa.PublicKey:
+		_, ok = t.Method.(*jwt.SigningMethodECDSA)
+	case []byte:
+		_, ok = t.Method.(*jwt.SigningMethodHMAC)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+	}
+	return k.key, nil
+}
+
+// validate check the registered claims, a token must expire and be issued for the audience
+func (v *Verifier) validate(claims jwt.MapClaims, now time.Time) error {
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("missing exp claim")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(v.Leeway)) {
+		return errors.New("token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token is not valid yet")
+	}
+	if v.Audience != "" && !contains(stringList(claims["aud"]), v.Audience) {
+		return errors.New("token is not issued for this audience")
+	}
+	if v.Issuer != "" && claims["iss"] != v.Issuer {
+		return errors.New("token is not issued by a trusted issuer")
+	}
+	return nil
+}
+
+// principal map the claims to a principal
+func (v *Verifier) principal(claims jwt.MapClaims) (*Principal, error) {
+	claim := func(field string) interface{} {
+		if name, ok := v.Claims[field]; ok {
+			return claims[name]
+		}
+		return claims[DefaultClaims[field]]
+	}
+	p := &Principal{Source: "jwt"}
+	p.Name, _ = claim(NameClaim).(string)
+	if p.Name == "" {
+		return nil, errors.New("invalid token: no name claim")
+	}
+	p.User, _ = claim(UserClaim).(string)
+	p.Databases = stringList(claim(DatabasesClaim))
+	p.Methods = stringList(claim(MethodsClaim))
+	p.Tables = stringList(claim(TablesClaim))
+	if len(v.RowFilters) > 0 {
+		p.RowFilters = make(map[string]string, len(v.RowFilters))
+	}
+	for table, template := range v.RowFilters {
+		predicate, err := expandRowFilter(template, claims)
+		if err != nil {
+			return nil, err
+		}
+		p.RowFilters[table] = predicate
+	}
+	return p, nil
+}
+
+// stringList a claim that holds a list either as an array of strings or as one string separated by spaces or
+// commas, as scopes are
+func stringList(claim interface{}) []string {
+	switch c := claim.(type) {
+	case string:
+		return strings.FieldsFunc(c, func(r rune) bool { return r == ' ' || r == ',' })
+	case []interface{}:
+		var list []string
+		for _, e := range c {
+			if s, ok := e.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// jwk a json web key, only the members needed to verify signatures
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// readJWKS read the signature keys of a json web key set, keys for encryption are skipped
+func readJWKS(name string) ([]verificationKey, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err.Error())
+	}
+	var keys []verificationKey
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %d: %s", name, i, err.Error())
+		}
+		keys = append(keys, verificationKey{id: k.Kid, alg: k.Alg, key: key})
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(k.K)
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// decodeInt a big endian integer in unpadded base64url, as jwk members are encoded
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("missing key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,159 @@
+package authutil
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// testVerifier a verifier for the audience mapd-api that trusts a new rsa key, and the key and its pem encoding
+func testVerifier(t *testing.T) (*Verifier, *rsa.PrivateKey, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	dir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(name, pub, 0600); err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVerifier(nil, []string{name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Audience = "mapd-api"
+	return v, key, pub
+}
+
+func TestVerify(t *testing.T) {
+	v, key, pub := testVerifier(t)
+	exp := time.Now().Add(time.Hour).Unix()
+	claims := func(extra jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{"sub": "alice", "aud": "mapd-api", "exp": exp}
+		for k, value := range extra {
+			if value == nil {
+				delete(c, k)
+			} else {
+				c[k] = value
+			}
+		}
+		return c
+	}
+	sign := func(method jwt.SigningMethod, c jwt.MapClaims, key interface{}) string {
+		s, err := jwt.NewWithClaims(method, c).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"valid", sign(jwt.SigningMethodRS256, claims(nil), key), true},
+		{"audience in a list", sign(jwt.SigningMethodRS256, claims(jwt.MapClaims{"aud": []string{"other", "mapd-api"}}), key), true},
+		{"expired", sign(jwt.SigningMethodRS256, claims(jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}), key), false},
+		{"just expired", sign(jwt.SigningMethodRS256, claims(jwt.MapClaims{"exp": time.Now().Add(-time.Second).Unix()}), key), false},
+		{"no exp", sign(jwt.SigningMethodRS256, claims(jwt.MapClaims{"exp": nil}), key), false},
+		{"not valid yet", sign(jwt.SigningMethodRS256, claims(jwt.MapClaims{"nbf": time.Now().Add(time.Hour).Unix()}), key), false},
+		{"wrong aud", sign(jwt.SigningMethodRS256, claims(jwt.MapClaims{"aud": "other"}), key), false},
+		{"wrong aud in a list", sign(jwt.SigningMethodRS256, claims(jwt.MapClaims{"aud": []string{"other"}}), key), false},
+		{"no aud", sign(jwt.SigningMethodRS256, claims(jwt.MapClaims{"aud": nil}), key), false},
+		{"alg none", sign(jwt.SigningMethodNone, claims(nil), jwt.UnsafeAllowNoneSignatureType), false},
+		{"hmac with the rsa public key", sign(jwt.SigningMethodHS256, claims(nil), pub), false},
+		{"other rsa key", sign(jwt.SigningMethodRS256, claims(nil), mustKey(t)), false},
+		{"no sub", sign(jwt.SigningMethodRS256, claims(jwt.MapClaims{"sub": nil}), key), false},
+		{"malformed", "not.a.token", false},
+	}
+	for _, test := range tests {
+		p, err := v.Verify(test.token)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: verified as %+v, want an error", test.name, p)
+		}
+	}
+}
+
+func TestVerifyClaims(t *testing.T) {
+	v, key, _ := testVerifier(t)
+	exp := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name    string
+		mapping map[string]string
+		claims  jwt.MapClaims
+		want    Principal
+	}{
+		{
+			"defaults",
+			nil,
+			jwt.MapClaims{"mapd_user": "analyst", "databases": []string{"mapd"}, "tables": "flights,airports"},
+			Principal{Name: "alice", Source: "jwt", User: "analyst", Databases: []string{"mapd"}, Tables: []string{"flights", "airports"}},
+		},
+		{
+			"no impersonation",
+			nil,
+			jwt.MapClaims{"role": "analyst"},
+			Principal{Name: "alice", Source: "jwt"},
+		},
+		{
+			"mapped claims",
+			map[string]string{UserClaim: "role", TablesClaim: "scope"},
+			jwt.MapClaims{"role": "analyst", "mapd_user": "admin", "scope": "flights read", "tables": "secret"},
+			Principal{Name: "alice", Source: "jwt", User: "analyst", Tables: []string{"flights", "read"}},
+		},
+		{
+			"mapped claim missing",
+			map[string]string{UserClaim: "role"},
+			jwt.MapClaims{"mapd_user": "admin"},
+			Principal{Name: "alice", Source: "jwt"},
+		},
+	}
+	for _, test := range tests {
+		v.Claims = test.mapping
+		claims := jwt.MapClaims{"sub": "alice", "aud": "mapd-api", "exp": exp}
+		for k, value := range test.claims {
+			claims[k] = value
+		}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := v.Verify(token)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*p, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, *p, test.want)
+		}
+	}
+}
+
+func mustKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
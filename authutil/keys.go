@@ -0,0 +1,136 @@
+package authutil
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/shusson/mapd-api/metricsutil"
+)
+
+// keyPrefix of the redis keys api keys are stored under, followed by the sha256 of the api key
+const keyPrefix = "mapd-api:apikey:"
+
+// ErrUnknownKey the api key is not configured
+var ErrUnknownKey = errors.New("invalid api key")
+
+var sha256Hex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Key an api key and what it grants as given in the configuration. The key is given either as is or as the hex
+// sha256 of it, so that the configuration need not hold the key itself.
+type Key struct {
+	Principal
+	Key       string `json:"key,omitempty"`
+	KeySHA256 string `json:"key_sha256,omitempty"`
+}
+
+// keyFields the fields of a Key, anything else in a configured key is a mistake that would otherwise go unnoticed
+var keyFields = map[string]bool{
+	"name": true, "key": true, "key_sha256": true, "user": true, "databases": true, "methods": true,
+	"tables": true, "row_filters": true, "rate_limit": true, "burst": true,
+	"max_concurrent": true,
+}
+
+// ParseKeys parse a json object or list of objects of configured api keys
+func ParseKeys(value string) ([]Key, error) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "[") {
+		value = "[" + value + "]"
+	}
+	var fields []map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return nil, err
+	}
+	for _, f := range fields {
+		var unknown []string
+		for name := range f {
+			if !keyFields[name] {
+				unknown = append(unknown, name)
+			}
+		}
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+			return nil, fmt.Errorf("api key %v: unknown fields %s", f["name"], strings.Join(unknown, ", "))
+		}
+	}
+	var keys []Key
+	if err := json.Unmarshal([]byte(value), &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Keys the principals of the configured api keys by the sha256 of the key
+type Keys map[string]*Principal
+
+// Add a configured api key
+func (k Keys) Add(key Key) error {
+	if key.Name == "" {
+		return fmt.Errorf("api key without a name")
+	}
+	hash := key.KeySHA256
+	switch {
+	case key.Key != "" && hash != "":
+		return fmt.Errorf("api key %s: key and key_sha256 must not both be given", key.Name)
+	case key.Key != "":
+		hash = HashKey(key.Key)
+	case !sha256Hex.MatchString(hash):
+		return fmt.Errorf("api key %s: expected a key or a key_sha256 of 64 lower case hex digits", key.Name)
+	}
+	if err := CheckRowFilters(key.RowFilters); err != nil {
+		return fmt.Errorf("api key %s: %s", key.Name, err.Error())
+	}
+	if key.RateLimit < 0 || key.Burst < 0 || key.MaxConcurrent < 0 {
+		return fmt.Errorf("api key %s: rate_limit, burst and max_concurrent must not be negative", key.Name)
+	}
+	if p, ok := k[hash]; ok {
+		return fmt.Errorf("api key %s: same key as %s", key.Name, p.Name)
+	}
+	principal := key.Principal
+	principal.Source = "api-key"
+	k[hash] = &principal
+	return nil
+}
+
+// HashKey the hex sha256 of an api key, the form keys are configured and stored in redis under
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Lookup the principal of an api key. Keys are looked up in keys and then, if pool is not nil, in redis where the
+// principal is stored as json under mapd-api:apikey:<sha256 of the key>. ErrUnknownKey if the key is in neither.
+func Lookup(keys Keys, pool *redis.Pool, key string) (*Principal, error) {
+	hash := HashKey(key)
+	if p, ok := keys[hash]; ok {
+		return p, nil
+	}
+	if pool == nil {
+		return nil, ErrUnknownKey
+	}
+	conn := pool.Get()
+	defer conn.Close()
+
+	value, err := redis.Bytes(conn.Do("GET", keyPrefix+hash))
+	if err == redis.ErrNil {
+		return nil, ErrUnknownKey
+	}
+	if err != nil {
+		metricsutil.RedisErrors.WithLabelValues("apikey").Inc()
+		return nil, err
+	}
+	p := Principal{Source: "api-key"}
+	if err := json.Unmarshal(value, &p); err != nil {
+		return nil, fmt.Errorf("unreadable api key %s: %s", keyPrefix+hash, err.Error())
+	}
+	if p.Name == "" {
+		p.Name = hash[:8]
+	}
+	return &p, nil
+}
@@ -0,0 +1,171 @@
+package authutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/shusson/mapd-api/sqlutil"
+	"github.com/shusson/mapd-api/thriftutil"
+)
+
+// unfilterable methods that read or write rows without sql the proxy can rewrite
+var unfilterable = map[string]bool{
+	"start_query": true, "execute_first_step": true, "insert_data": true,
+	"get_row_for_pixel": true, "get_rows_for_pixels": true, "get_result_row_for_pixel": true,
+}
+
+// tableWrites methods that write to the table they name
+var tableWrites = map[string]bool{
+	"load_table": true, "load_table_binary": true, "import_table": true, "import_geo_table": true,
+	"create_table": true,
+}
+
+// placeholder a claim in a row filter template, e.g. {tenant}
+var placeholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// CheckRowFilters whether every row filter is a single predicate that can not end the statement or the parentheses
+// it is added in
+func CheckRowFilters(filters map[string]string) error {
+	for table, predicate := range filters {
+		if table == "" || len(sqlutil.Statements(predicate)) != 1 || !balanced(predicate) {
+			return fmt.Errorf("row filter %s=%q is not a single predicate", table, predicate)
+		}
+	}
+	return nil
+}
+
+// balanced whether every parenthesis outside of literals is closed in order
+func balanced(predicate string) bool {
+	depth := 0
+	for _, t := range sqlutil.Tokenize(predicate) {
+		if t.Kind != sqlutil.Symbol {
+			continue
+		}
+		switch t.Text {
+		case "(":
+			depth++
+		case ")":
+			if depth--; depth < 0 {
+				return false
+			}
+		}
+	}
+	return depth == 0
+}
+
+// expandRowFilter replace every placeholder of a row filter template with the value of the claim it names as a sql
+// literal, a list claim becomes a comma separated list of literals for use with IN
+func expandRowFilter(template string, claims map[string]interface{}) (string, error) {
+	var missing string
+	predicate := placeholder.ReplaceAllStringFunc(template, func(m string) string {
+		name := m[1 : len(m)-1]
+		literal, ok := sqlLiteral(claims[name])
+		if !ok && missing == "" {
+			missing = name
+		}
+		return literal
+	})
+	if missing != "" {
+		return "", fmt.Errorf("invalid token: no %s claim for a row filter", missing)
+	}
+	return predicate, nil
+}
+
+func sqlLiteral(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return "'" + strings.Replace(v, "'", "''", -1) + "'", true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strings.ToUpper(strconv.FormatBool(v)), true
+	case []interface{}:
+		literals := make([]string, 0, len(v))
+		for _, e := range v {
+			literal, ok := sqlLiteral(e)
+			if !ok {
+				return "", false
+			}
+			literals = append(literals, literal)
+		}
+		return strings.Join(literals, ", "), len(literals) > 0
+	}
+	return "", false
+}
+
+// FilterRows rewrite the sql of the call so that it only reads the rows the principal's row filters select, the
+// sql of every data source of a vega spec included. An error with a message for the client if the call can not be
+// filtered. A nil principal or one without row filters reads every row.
+func (p *Principal) FilterRows(req *thriftutil.Request) error {
+	if p == nil || len(p.RowFilters) == 0 {
+		return nil
+	}
+	if unfilterable[req.Method] {
+		return fmt.Errorf("%s is not permitted for %s, its rows are filtered", req.Method, p.Name)
+	}
+	if name := req.TableName(); tableWrites[req.Method] && p.filters(name) {
+		return fmt.Errorf("%s on %s is not permitted for %s, its rows are filtered", req.Method, name, p.Name)
+	}
+	if query := req.Query(); query != "" {
+		filtered, err := sqlutil.AddRowFilters(query, p.RowFilters)
+		if err != nil {
+			return err
+		}
+		req.SetQuery(filtered)
+	}
+	if vega := req.VegaJSON(); vega != "" {
+		filtered, err := filterVega(vega, p.RowFilters)
+		if err != nil {
+			return err
+		}
+		req.SetVegaJSON(filtered)
+	}
+	return nil
+}
+
+// filters whether the principal has a row filter for the table
+func (p *Principal) filters(table string) bool {
+	for t := range p.RowFilters {
+		if strings.EqualFold(t, table) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterVega add the row filters to the sql of every data source of a vega spec
+func filterVega(vega string, filters map[string]string) (string, error) {
+	d := json.NewDecoder(strings.NewReader(vega))
+	d.UseNumber()
+	var spec map[string]interface{}
+	if err := d.Decode(&spec); err != nil {
+		return "", fmt.Errorf("unreadable vega spec: %s", err.Error())
+	}
+	data, _ := spec["data"].([]interface{})
+	for _, source := range data {
+		source, ok := source.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		query, ok := source["sql"].(string)
+		if !ok {
+			continue
+		}
+		filtered, err := sqlutil.AddRowFilters(query, filters)
+		if err != nil {
+			return "", err
+		}
+		source["sql"] = filtered
+	}
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(spec); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(b.String()), nil
+}
@@ -0,0 +1,44 @@
+package cacheutil
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/shusson/mapd-api/sqlutil"
+)
+
+const keyPrefix = "mapd-api:query:"
+
+// Key identifies a cached response by everything that affects it except the session it was made with
+type Key struct {
+	Database     string `json:"db"`
+	User         string `json:"user"`
+	Method       string `json:"method"`
+	Query        string `json:"query"`
+	ColumnFormat bool   `json:"column_format"`
+	FirstN       int32  `json:"first_n"`
+	Version      string `json:"version"`
+	// Principal the caller whose row filters the query was rewritten with, empty if it was not
+	Principal string `json:"principal,omitempty"`
+}
+
+// NewKey construct a key, the query is normalized so that formatting differences share an entry
+func NewKey(db string, user string, method string, query string, columnFormat bool, firstN int32, version string) Key {
+	return Key{
+		Database:     db,
+		User:         user,
+		Method:       method,
+		Query:        sqlutil.NormalizeQuery(query),
+		ColumnFormat: columnFormat,
+		FirstN:       firstN,
+		Version:      version,
+	}
+}
+
+// String the redis key, a hash of all fields so that long queries make short keys
+func (k Key) String() string {
+	b, _ := json.Marshal(k)
+	sum := sha256.Sum256(b)
+	return keyPrefix + hex.EncodeToString(sum[:])
+}
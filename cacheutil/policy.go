@@ -0,0 +1,40 @@
+package cacheutil
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// PatternTTL a ttl for queries matching a regular expression
+type PatternTTL struct {
+	Pattern *regexp.Regexp
+	TTL     time.Duration
+}
+
+// Policy how long cached responses live, a zero ttl means the entry never expires
+type Policy struct {
+	DefaultTTL  time.Duration
+	TableTTLs   map[string]time.Duration
+	PatternTTLs []PatternTTL
+}
+
+// TTL the ttl for a query. The first matching pattern wins, otherwise the shortest override of the
+// referenced tables, otherwise the default.
+func (p Policy) TTL(query string, tables []string) time.Duration {
+	for _, pt := range p.PatternTTLs {
+		if pt.Pattern.MatchString(query) {
+			return pt.TTL
+		}
+	}
+	ttl, found := time.Duration(0), false
+	for _, table := range tables {
+		if t, ok := p.TableTTLs[strings.ToLower(table)]; ok && (!found || t < ttl) {
+			ttl, found = t, true
+		}
+	}
+	if found {
+		return ttl
+	}
+	return p.DefaultTTL
+}
@@ -0,0 +1,138 @@
+package cacheutil
+
+import (
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/shusson/mapd-api/metricsutil"
+)
+
+const tablePrefix = "mapd-api:table:"
+
+// storeScript set the entry and add it to the index of every table it references. An index lives at
+// least as long as its longest lived entry.
+// KEYS[1] entry, KEYS[2..n] table indexes, ARGV[1] value, ARGV[2] ttl in seconds or 0
+var storeScript = redis.NewScript(-1, `
+local ttl = tonumber(ARGV[2])
+if ttl > 0 then
+	redis.call('SET', KEYS[1], ARGV[1], 'EX', ttl)
+else
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+for i = 2, #KEYS do
+	local existed = redis.call('EXISTS', KEYS[i])
+	redis.call('SADD', KEYS[i], KEYS[1])
+	if ttl <= 0 then
+		redis.call('PERSIST', KEYS[i])
+	else
+		local current = redis.call('TTL', KEYS[i])
+		if existed == 0 or (current >= 0 and current < ttl) then
+			redis.call('EXPIRE', KEYS[i], ttl)
+		end
+	end
+end
+return 1
+`)
+
+// invalidateScript delete every entry in a table index and the index itself, returns the number of entries
+// KEYS[1] table index
+var invalidateScript = redis.NewScript(1, `
+local keys = redis.call('SMEMBERS', KEYS[1])
+for _, key in ipairs(keys) do
+	redis.call('DEL', key)
+end
+redis.call('DEL', KEYS[1])
+return #keys
+`)
+
+// tableKey the redis key of the index of entries that reference a table
+func tableKey(table string) string {
+	return tablePrefix + strings.ToLower(table)
+}
+
+// Store cache a value with a ttl and index it by the tables it references
+func Store(pool *redis.Pool, key string, value []byte, ttl time.Duration, tables []string) error {
+	conn := pool.Get()
+	defer conn.Close()
+
+	keys := make([]interface{}, 0, len(tables)+3)
+	keys = append(keys, len(tables)+1, key)
+	for _, table := range tables {
+		keys = append(keys, tableKey(table))
+	}
+	seconds := int64(ttl / time.Second)
+	if ttl > 0 && seconds == 0 {
+		seconds = 1
+	}
+	args := append(keys, value, seconds)
+	if _, err := storeScript.Do(conn, args...); err != nil {
+		metricsutil.RedisErrors.WithLabelValues("store").Inc()
+		return err
+	}
+	metricsutil.CacheSets.Inc()
+	return nil
+}
+
+// InvalidateTable delete every cached entry that references the table, returns the number of entries deleted
+func InvalidateTable(pool *redis.Pool, table string) (int, error) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	n, err := redis.Int(invalidateScript.Do(conn, tableKey(table)))
+	if err != nil {
+		metricsutil.RedisErrors.WithLabelValues("invalidate").Inc()
+	}
+	return n, err
+}
+
+// InvalidateAll delete every cached entry and table index, returns the number of keys deleted
+func InvalidateAll(pool *redis.Pool) (int, error) {
+	n, err := invalidateAll(pool)
+	if err != nil {
+		metricsutil.RedisErrors.WithLabelValues("invalidate").Inc()
+	}
+	return n, err
+}
+
+// invalidateAll delete the entries and indexes only, other mapd-api keys such as api keys are kept
+func invalidateAll(pool *redis.Pool) (int, error) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	n := 0
+	for _, prefix := range []string{keyPrefix, tablePrefix} {
+		deleted, err := deleteMatching(conn, prefix+"*")
+		n += deleted
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// deleteMatching delete every key that matches the pattern, returns the number of keys deleted
+func deleteMatching(conn redis.Conn, pattern string) (int, error) {
+	n := 0
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return n, err
+		}
+		var keys []interface{}
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return n, err
+		}
+		if len(keys) > 0 {
+			deleted, err := redis.Int(conn.Do("DEL", keys...))
+			if err != nil {
+				return n, err
+			}
+			n += deleted
+		}
+		if cursor == 0 {
+			return n, nil
+		}
+	}
+}
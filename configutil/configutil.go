@@ -0,0 +1,225 @@
+package configutil
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Repeatable a flag that can be given more than once, every element of a list or mapping in the config file
+// and every line of an environment variable is passed to Set. Lines rather than commas separate the values of an
+// environment variable since patterns and predicates hold commas.
+type Repeatable interface {
+	flag.Value
+	Repeatable() bool
+}
+
+// Structured a flag whose value is a json document. A mapping or list in the config file is passed to Set as
+// json and an environment variable is passed to Set whole.
+type Structured interface {
+	flag.Value
+	Structured() bool
+}
+
+// EnvName the environment variable that sets a flag, e.g. MAPD_API_CACHE_TTL for cache-ttl
+func EnvName(prefix string, name string) string {
+	return prefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// Load parse the command line into the flag set, then set every flag that was not given on the command line from
+// its environment variable and failing that from the config file named by the config flag. Flags given on the
+// command line take precedence over the environment, which takes precedence over the config file.
+func Load(fs *flag.FlagSet, args []string, prefix string, configFlag string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var errs []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] {
+			return
+		}
+		value, ok := os.LookupEnv(EnvName(prefix, f.Name))
+		if !ok {
+			return
+		}
+		values := []string{value}
+		// json spans lines, so a structured flag is never split
+		_, structured := f.Value.(Structured)
+		if _, ok := f.Value.(Repeatable); ok && !structured {
+			values = nil
+			for _, line := range strings.Split(value, "\n") {
+				if line = strings.TrimSpace(line); line != "" {
+					values = append(values, line)
+				}
+			}
+		}
+		for _, v := range values {
+			if err := fs.Set(f.Name, strings.TrimSpace(v)); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: invalid value %q: %s", EnvName(prefix, f.Name), v, err.Error()))
+				return
+			}
+		}
+		set[f.Name] = true
+	})
+	if len(errs) > 0 {
+		return Invalid(errs)
+	}
+
+	path := ""
+	if f := fs.Lookup(configFlag); f != nil {
+		path = f.Value.String()
+	}
+	if path == "" {
+		return nil
+	}
+	config, err := ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for _, item := range config {
+		name := fmt.Sprint(item.Key)
+		f := fs.Lookup(name)
+		if f == nil || name == configFlag {
+			errs = append(errs, fmt.Sprintf("%s: unknown setting %q", path, name))
+			continue
+		}
+		if set[name] {
+			continue
+		}
+		values, err := fileValues(f, item.Value)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s: %s", path, name, err.Error()))
+			continue
+		}
+		for _, v := range values {
+			if err := fs.Set(name, v); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s: invalid value %q: %s", path, name, v, err.Error()))
+				break
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return Invalid(errs)
+	}
+	return nil
+}
+
+// ReadFile read a yaml config file, the settings are kept in file order
+func ReadFile(path string) (yaml.MapSlice, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config yaml.MapSlice
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return config, nil
+}
+
+// ReadSecret read a secret such as a password from a file, surrounding whitespace is dropped
+func ReadSecret(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// fileValues the values to pass to Set for a setting of the config file. A list for a flag that is not repeatable
+// is joined with commas, mappings are only accepted for repeatable flags and passed as key=value.
+func fileValues(f *flag.Flag, value interface{}) ([]string, error) {
+	if _, ok := f.Value.(Structured); ok {
+		if value == nil {
+			return nil, nil
+		}
+		b, err := json.Marshal(jsonValue(value))
+		if err != nil {
+			return nil, err
+		}
+		return []string{string(b)}, nil
+	}
+	_, repeatable := f.Value.(Repeatable)
+	switch v := value.(type) {
+	case []interface{}:
+		var values []string
+		for _, e := range v {
+			if !scalar(e) {
+				return nil, fmt.Errorf("expected a list of values")
+			}
+			values = append(values, fmt.Sprint(e))
+		}
+		if !repeatable {
+			return []string{strings.Join(values, ",")}, nil
+		}
+		return values, nil
+	case yaml.MapSlice:
+		if !repeatable {
+			return nil, fmt.Errorf("expected a single value, not a mapping")
+		}
+		var values []string
+		for _, e := range v {
+			if !scalar(e.Value) {
+				return nil, fmt.Errorf("expected a mapping of name to value")
+			}
+			values = append(values, fmt.Sprintf("%v=%v", e.Key, e.Value))
+		}
+		return values, nil
+	case nil:
+		return nil, nil
+	}
+	if !scalar(value) {
+		return nil, fmt.Errorf("unexpected value %v", value)
+	}
+	return []string{fmt.Sprint(value)}, nil
+}
+
+// jsonValue convert the mappings yaml decodes to, which json can not encode, to string keyed maps
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		m := make(map[string]interface{}, len(v))
+		for _, e := range v {
+			m[fmt.Sprint(e.Key)] = jsonValue(e.Value)
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = jsonValue(e)
+		}
+		return l
+	}
+	return v
+}
+
+func scalar(v interface{}) bool {
+	switch v.(type) {
+	case string, int, int64, uint64, float64, bool:
+		return true
+	}
+	return false
+}
+
+// Invalid every problem with the configuration as one error, one problem per line
+func Invalid(errs []string) error {
+	sort.Strings(errs)
+	return fmt.Errorf("invalid configuration:\n  %s", strings.Join(errs, "\n  "))
+}
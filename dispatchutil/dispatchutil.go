@@ -0,0 +1,76 @@
+package dispatchutil
+
+import (
+	"net/http"
+
+	"github.com/shusson/mapd-api/thriftutil"
+)
+
+// Handler serves a decoded thrift call in place of forwarding it to mapd-core
+type Handler interface {
+	ServeThrift(w http.ResponseWriter, r *http.Request, req *thriftutil.Request)
+}
+
+// HandlerFunc adapter to allow the use of ordinary functions as thrift handlers
+type HandlerFunc func(w http.ResponseWriter, r *http.Request, req *thriftutil.Request)
+
+// ServeThrift calls f(w, r, req)
+func (f HandlerFunc) ServeThrift(w http.ResponseWriter, r *http.Request, req *thriftutil.Request) {
+	f(w, r, req)
+}
+
+// Route how the proxy treats calls to a single mapd thrift method
+type Route struct {
+	// InjectSession replace the client session with the proxy session
+	InjectSession bool
+	// Cache serve the call from the cache and cache the response
+	Cache bool
+	// Deny reject the call without forwarding it to mapd-core
+	Deny bool
+	// Invalidate purge cached responses for the tables the call writes to
+	Invalidate bool
+	// Handler serves the call instead of the reverse proxy, optional
+	Handler Handler
+	// Handles whether Handler serves a call, calls it does not are forwarded. Nil if Handler serves every call.
+	Handles func(req *thriftutil.Request) bool
+}
+
+// Serves whether the route's handler serves the call instead of the reverse proxy
+func (r Route) Serves(req *thriftutil.Request) bool {
+	return r.Handler != nil && (r.Handles == nil || r.Handles(req))
+}
+
+// Dispatcher routing table keyed on the thrift method name
+type Dispatcher struct {
+	routes map[string]Route
+}
+
+// NewDispatcher construct a dispatcher with a route for every method in the mapd.MapD interface.
+// Methods that take a session get the proxy session injected, sql_execute is cached and the
+// leaf to aggregator methods are denied. sql_execute and the methods that load data invalidate the cache
+// for the tables they write to.
+func NewDispatcher() *Dispatcher {
+	d := &Dispatcher{routes: make(map[string]Route)}
+	for _, method := range thriftutil.Methods() {
+		d.routes[method] = Route{InjectSession: true}
+	}
+	d.routes["connect"] = Route{}
+	d.routes["get_version"] = Route{}
+	d.routes["sql_execute"] = Route{InjectSession: true, Cache: true, Invalidate: true}
+	for _, method := range []string{"load_table", "load_table_binary", "import_table", "import_geo_table", "insert_data", "create_table"} {
+		d.routes[method] = Route{InjectSession: true, Invalidate: true}
+	}
+	d.routes["execute_first_step"] = Route{Deny: true}
+	d.routes["broadcast_serialized_rows"] = Route{Deny: true}
+	return d
+}
+
+// Handle register the route for a method, replacing any existing route
+func (d *Dispatcher) Handle(method string, route Route) {
+	d.routes[method] = route
+}
+
+// Route the route for a method, methods without a route are forwarded untouched
+func (d *Dispatcher) Route(method string) Route {
+	return d.routes[method]
+}
@@ -0,0 +1,83 @@
+package healthutil
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/shusson/mapd-api/mapdutil"
+	"github.com/shusson/mapd-api/thrift/e745367/mapd"
+)
+
+// Check the outcome of checking a single dependency
+type Check struct {
+	Name      string  `json:"name"`
+	Target    string  `json:"target,omitempty"`
+	OK        bool    `json:"ok"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Report the outcome of a readiness check, ready when at least one mapd backend with a valid session is. Redis is
+// reported but not required, requests are served without the cache while it is down.
+type Report struct {
+	Ready  bool    `json:"ready"`
+	Checks []Check `json:"checks"`
+}
+
+// Readiness check every mapd backend and redis, if cache is not nil
+func Readiness(pool *mapdutil.BackendPool, cache *redis.Pool) Report {
+	report := Report{Checks: []Check{}}
+	if cache != nil {
+		report.Checks = append(report.Checks, CheckRedis(cache))
+	}
+	for _, b := range pool.Backends() {
+		status, session := CheckBackend(b)
+		report.Checks = append(report.Checks, status, session)
+		report.Ready = report.Ready || status.OK && session.OK
+	}
+	return report
+}
+
+// CheckRedis ping redis
+func CheckRedis(cache *redis.Pool) Check {
+	conn := cache.Get()
+	defer conn.Close()
+
+	start := time.Now()
+	_, err := conn.Do("PING")
+	return newCheck("redis", "", start, err)
+}
+
+// CheckBackend call GetServerStatus on the backend. The first check is whether mapd-core answered, the second
+// whether it accepted the session.
+func CheckBackend(b *mapdutil.Backend) (Check, Check) {
+	target := b.URL.String()
+	conn := b.Conn()
+	if conn == nil {
+		status := Check{Name: "mapd", Target: target, Error: "not connected"}
+		return status, Check{Name: "session", Target: target, Error: "not connected"}
+	}
+
+	start := time.Now()
+	_, err := conn.ServerInfo()
+	status := newCheck("mapd", target, start, err)
+	session := newCheck("session", target, start, err)
+	if e, ok := err.(*mapd.TMapDException); ok {
+		// mapd-core answered, it only rejected the call
+		status.OK = true
+		status.Error = ""
+		if !mapdutil.IsInvalidSession(e) {
+			session.OK = true
+			session.Error = ""
+		}
+	}
+	return status, session
+}
+
+func newCheck(name string, target string, start time.Time, err error) Check {
+	c := Check{Name: name, Target: target, OK: err == nil, LatencyMs: float64(time.Since(start)) / float64(time.Millisecond)}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	return c
+}
@@ -0,0 +1,138 @@
+package logutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// JSON one json object per line
+	JSON = "json"
+	// Text one line of space separated key=value pairs
+	Text = "text"
+)
+
+// Entry a proxied request as written to the access log
+type Entry struct {
+	Time            time.Time `json:"time"`
+	ClientIP        string    `json:"client_ip"`
+	Method          string    `json:"method"`
+	User            string    `json:"user,omitempty"`
+	Principal       string    `json:"principal,omitempty"`
+	Fingerprint     string    `json:"fingerprint,omitempty"`
+	FingerprintID   string    `json:"fingerprint_id,omitempty"`
+	Query           string    `json:"query,omitempty"`
+	Cache           string    `json:"cache,omitempty"`
+	Backend         string    `json:"backend,omitempty"`
+	Status          int       `json:"status"`
+	UpstreamStatus  int       `json:"upstream_status,omitempty"`
+	BytesIn         int       `json:"bytes_in"`
+	BytesOut        int       `json:"bytes_out"`
+	DurationMs      float64   `json:"duration_ms"`
+	UpstreamMs      float64   `json:"upstream_ms,omitempty"`
+	ExecutionTimeMs int64     `json:"mapd_execution_ms,omitempty"`
+	TotalTimeMs     int64     `json:"mapd_total_ms,omitempty"`
+}
+
+// AccessLog writes an entry per request, safe for concurrent use. A nil AccessLog discards entries.
+type AccessLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	format string
+}
+
+// NewAccessLog open an access log writing in format to stdout, stderr or appending to a file. An empty
+// destination disables the log.
+func NewAccessLog(format string, destination string) (*AccessLog, error) {
+	if format != JSON && format != Text {
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+	if destination == "" {
+		return nil, nil
+	}
+	l := &AccessLog{format: format}
+	switch destination {
+	case "stdout":
+		l.w = os.Stdout
+	case "stderr":
+		l.w = os.Stderr
+	default:
+		f, err := os.OpenFile(destination, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		l.w = f
+		l.closer = f
+	}
+	return l, nil
+}
+
+// Log write an entry
+func (l *AccessLog) Log(e Entry) {
+	if l == nil {
+		return
+	}
+	var line []byte
+	if l.format == Text {
+		line = text(e)
+	} else {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		line = append(b, '\n')
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(line)
+}
+
+// Close close the log file, stdout and stderr are left open
+func (l *AccessLog) Close() error {
+	if l == nil || l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// text format an entry as key=value pairs with the same keys as the json format, empty fields are left out
+func text(e Entry) []byte {
+	b, _ := json.Marshal(e)
+	var fields map[string]interface{}
+	json.Unmarshal(b, &fields)
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		if k != "time" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.WriteString(e.Time.Format(time.RFC3339Nano))
+	for _, k := range keys {
+		switch v := fields[k].(type) {
+		case string:
+			fmt.Fprintf(&buf, " %s=%q", k, v)
+		case float64:
+			fmt.Fprintf(&buf, " %s=%s", k, strconv.FormatFloat(v, 'f', -1, 64))
+		default:
+			fmt.Fprintf(&buf, " %s=%v", k, v)
+		}
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// Milliseconds a duration in fractional milliseconds
+func Milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
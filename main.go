@@ -1,17 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"net"
 	"net/url"
 	"log"
 	"net/http"
 	"io/ioutil"
-	"regexp"
 	"fmt"
 	"flag"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 	"syscall"
+	"sync/atomic"
 	"os/signal"
 	"github.com/gorilla/mux"
 	"encoding/json"
@@ -19,22 +25,83 @@ import (
 	"github.com/shusson/mapd-api/redisutil"
 	"github.com/shusson/mapd-api/proxyutil"
 	"github.com/shusson/mapd-api/mapdutil"
-	"errors"
+	"github.com/shusson/mapd-api/thriftutil"
+	"github.com/shusson/mapd-api/dispatchutil"
+	"github.com/shusson/mapd-api/cacheutil"
+	"github.com/shusson/mapd-api/sqlutil"
+	"github.com/shusson/mapd-api/healthutil"
+	"github.com/shusson/mapd-api/metricsutil"
+	"github.com/shusson/mapd-api/logutil"
+	"github.com/shusson/mapd-api/statsutil"
+	"github.com/shusson/mapd-api/configutil"
+	"github.com/shusson/mapd-api/tlsutil"
+	"github.com/shusson/mapd-api/policyutil"
+	"github.com/shusson/mapd-api/authutil"
+	"github.com/shusson/mapd-api/ratelimitutil"
+	"github.com/shusson/mapd-api/thrift/e745367/mapd"
 )
 
 type opts struct {
-	url          *url.URL
-	user         string
-	db           string
-	pwd          string
-	httpPort     int
-	bufferSize   int
-	redisAddress string
+	urls                   []*url.URL
+	balance                string
+	healthInterval         time.Duration
+	user                   string
+	db                     string
+	pwd                    string
+	httpPort               int
+	adminAddr              string
+	bufferSize             int
+	clientPoolSize         int
+	redisAddress           string
+	cachePolicy            cacheutil.Policy
+	sessionMode            string
+	sessionIdle            time.Duration
+	accessLog              string
+	accessLogFormat        string
+	slowQueryLog           string
+	slowQueryThreshold     time.Duration
+	queryWindow            time.Duration
+	drainDelay             time.Duration
+	drainTimeout           time.Duration
+	tlsCert                string
+	tlsKey                 string
+	tlsClientCA            string
+	tlsClientAuth          string
+	upstreamCA             string
+	upstreamCert           string
+	upstreamKey            string
+	upstreamServerName     string
+	upstreamConnectTimeout time.Duration
+	upstreamTimeout        time.Duration
+	policy                 *policyutil.Policy
+	apiKeys                authutil.Keys
+	apiKeyRedis            bool
+	requireAPIKey          bool
+	verifier               *authutil.Verifier
+	impersonate            map[string]string
+	rateLimit              float64
+	rateBurst              int
+	maxConcurrent          int
+	limitBy                string
+	limitRedis             bool
+	limitResponse          string
+	limitExemptCacheHits   bool
+	// settings the value of every flag, used to report what changed on reload
+	settings map[string]string
 }
 
 func main() {
+	os.Exit(run())
+}
+
+// run serve until the api is shut down by a signal, returns the exit code. Resources are released by the
+// deferred calls once in-flight requests have drained.
+func run() int {
 
-	options, err := options()
+	options, err := options(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(2)
+	}
 	if err != nil  {
 		log.Fatal("failed parse flag options: " + err.Error())
 	}
@@ -42,74 +109,684 @@ func main() {
 	cache := redisutil.NewPool(options.redisAddress)
 	defer cache.Close()
 
-	conn, err := mapdutil.ConnectToMapDWithRetry(options.user, options.pwd, options.db, options.url.String(), options.bufferSize, 60, 2*time.Second)
-	if err != nil || conn.Session == "" {
-		log.Fatal("failed to connect to mapd server")
+	upstream, err := upstreamTransport(options)
+	if err != nil {
+		log.Fatal("failed to configure mapd server connections: " + err.Error())
 	}
+	client := &http.Client{Transport: upstream, Timeout: options.upstreamTimeout}
 
-	defer conn.Client.Disconnect(conn.Session)
-	defer conn.Client.Transport.Close()
+	pool, err := mapdutil.NewBackendPool(options.urls, options.balance, options.user, options.pwd, options.db, options.bufferSize, options.clientPoolSize, client, 60, 2*time.Second)
+	if err != nil {
+		log.Fatal("failed to connect to mapd server: " + err.Error())
+	}
+	defer pool.Close()
 
-	sigHandler(conn, cache)
+	stopHealth := make(chan struct{})
+	defer close(stopHealth)
+	go pool.CheckHealth(options.healthInterval, stopHealth)
+
+	accessLog, err := logutil.NewAccessLog(options.accessLogFormat, options.accessLog)
+	if err != nil {
+		log.Fatal("failed to open access log: " + err.Error())
+	}
+	defer accessLog.Close()
+	slowLog, err := logutil.NewAccessLog(logutil.JSON, options.slowQueryLog)
+	if err != nil {
+		log.Fatal("failed to open slow query log: " + err.Error())
+	}
+	defer slowLog.Close()
+	requests := &requestLog{access: accessLog, slow: slowLog, slowThreshold: options.slowQueryThreshold, queries: statsutil.NewWindow(options.queryWindow, 15)}
+
+	live := &liveOptions{}
+	live.Store(options)
+	reloadHandler(live, pool)
+
+	dispatcher := dispatchutil.NewDispatcher()
+	dispatcher.Handle("disconnect", dispatchutil.Route{Handler: dispatchutil.HandlerFunc(handleDisconnect), Handles: sharedDisconnect(pool)})
+
+	// client sessions, and in either mode the sessions of the users principals are impersonated with
+	sessions := mapdutil.NewSessionStore()
+	defer sessions.CloseAll()
+	if options.sessionMode == clientSessions {
+		dispatcher.Handle("connect", dispatchutil.Route{Handler: handleClientConnect(pool, sessions)})
+		dispatcher.Handle("disconnect", dispatchutil.Route{Handler: handleClientDisconnect(sessions)})
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			sessions.Expire(options.sessionIdle)
+		}
+	}()
 
 	r := mux.NewRouter()
-	r.HandleFunc("/healthcheck", healthCheck(conn))
-	r.HandleFunc("/", handleThriftRequests(string(conn.Session), cache, options))
+	r.HandleFunc("/healthcheck", healthCheck(pool))
+	r.HandleFunc("/healthz", liveness)
+	var draining int32
+	r.HandleFunc("/readyz", readiness(pool, redisCheck(cache, options.redisAddress), &draining))
+	var limitStore *redis.Pool
+	if options.limitRedis {
+		limitStore = cache
+	}
+	// a call that is never released, e.g. because the instance died, stops counting once it would have timed out
+	lease := options.upstreamTimeout
+	if lease <= 0 {
+		lease = 10 * time.Minute
+	}
+	limiter := ratelimitutil.NewLimiter(limitStore, lease)
+	r.HandleFunc("/", handleThriftRequests(pool, sessions, cache, dispatcher, requests, upstream, live, limiter))
 	http.Handle("/", r)
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", options.httpPort), r))
+	// the admin endpoints change and reveal what every client shares, so they are kept off the public listener
+	admin := mux.NewRouter()
+	admin.HandleFunc("/admin/cache/invalidate", invalidateCache(cache)).Methods("POST")
+	admin.HandleFunc("/admin/queries/top", topQueries(requests.queries)).Methods("GET")
+	admin.Handle("/metrics", metricsutil.Handler())
+	if options.adminAddr != "" {
+		adminServer, err := serveAdmin(options.adminAddr, admin)
+		if err != nil {
+			log.Fatal("failed to listen for admin requests: " + err.Error())
+		}
+		defer adminServer.Close()
+	}
+
+	server := &http.Server{Addr: fmt.Sprintf(":%d", options.httpPort), Handler: r}
+	if options.tlsCert != "" {
+		certs, err := tlsutil.NewCertReloader(options.tlsCert, options.tlsKey)
+		if err != nil {
+			log.Fatal("failed to load tls certificate: " + err.Error())
+		}
+		go certs.Watch(10*time.Second, stopHealth)
+		server.TLSConfig, err = tlsutil.ServerConfig(certs, options.tlsClientCA, options.tlsClientAuth)
+		if err != nil {
+			log.Fatal("failed to configure tls: " + err.Error())
+		}
+	}
+	drained := sigHandler(server, options.drainDelay, options.drainTimeout, &draining)
+	if err := listen(server); err != http.ErrServerClosed {
+		log.Println("failed to serve http: " + err.Error())
+		return 1
+	}
+	if err := <-drained; err != nil {
+		log.Println("failed to drain in-flight requests: " + err.Error())
+		return 1
+	}
+	log.Println("in-flight requests drained, disconnecting")
+	return 0
 }
 
-func handleThriftRequests(sessionID string, cache *redis.Pool, options opts) http.HandlerFunc {
+// envPrefix of the environment variables that set flags
+const envPrefix = "MAPD_API_"
+
+const (
+	// sharedSessions every client is proxied with the session opened with -user
+	sharedSessions = "shared"
+	// clientSessions every client connects as its own user and is proxied with a session for that user
+	clientSessions = "client"
+)
+
+const (
+	// limitByPrincipal calls are limited per api key or token subject, and per ip for callers with neither
+	limitByPrincipal = "principal"
+	// limitByIP calls are limited per client ip
+	limitByIP = "ip"
+	// limitThrift calls over the limits are answered with a thrift exception
+	limitThrift = "thrift"
+	// limitHTTP calls over the limits are answered with a 429
+	limitHTTP = "http"
+)
+
+func handleThriftRequests(pool *mapdutil.BackendPool, sessions *mapdutil.SessionStore, cache *redis.Pool, dispatcher *dispatchutil.Dispatcher, requests *requestLog, upstream http.RoundTripper, live *liveOptions, limiter *ratelimitutil.Limiter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		options := live.Load()
+		start := time.Now()
+		rec := metricsutil.NewStatusRecorder(w)
+		w = rec
+		entry := logutil.Entry{Time: start, ClientIP: clientIP(r), Method: "unknown"}
+		var t *proxyutil.Transport
+		var query string
+		defer func() {
+			metricsutil.ObserveRequest(entry.Method, rec.Status)
+			entry.Status = rec.Status
+			entry.BytesOut = rec.Bytes
+			entry.DurationMs = logutil.Milliseconds(time.Since(start))
+			if t != nil {
+				entry.UpstreamStatus = t.Status
+				entry.UpstreamMs = logutil.Milliseconds(t.Upstream)
+				entry.ExecutionTimeMs = t.ExecutionTimeMs
+				entry.TotalTimeMs = t.TotalTimeMs
+			}
+			requests.record(entry, query)
+		}()
+
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			http.Error(w, err.Error(), 502)
 			return
 		}
-		b := string(body[:])
+		entry.BytesIn = len(body)
 
-		if strings.Contains(b, "sql_execute") {
-			query, err := getSQLQuery(b)
-			if err != nil {
-				http.Error(w, err.Error(), 502)
+		principal, authErr := authenticate(r, cache, options)
+		authutil.StripCredentials(r)
+		if principal != nil {
+			entry.Principal = principal.Name
+		}
+		name, limits := clientLimits(options, principal, entry.ClientIP)
+
+		backend, err := pool.Next()
+		if err != nil {
+			http.Error(w, err.Error(), 503)
+			return
+		}
+		backend.Acquire()
+		defer backend.Release()
+		conn := backend.Conn()
+		entry.Backend = backend.URL.String()
+
+		// anything that is not a thrift call the proxy understands, e.g. a CORS preflight or a method of a newer
+		// mapd-core, is forwarded unchanged and answered by mapd-core as before
+		var req *thriftutil.Request
+		if r.Method == "POST" {
+			req, err = thriftutil.DecodeRequest(body)
+		}
+		if r.Method != "POST" || err != nil {
+			if err != nil && err != thriftutil.ErrUnknownMethod {
+				log.Printf("forwarding undecodable request from %s: %s\n", entry.ClientIP, err.Error())
+			}
+			// preflights never carry credentials
+			if authErr != nil && r.Method != "OPTIONS" {
+				metricsutil.Rejections.WithLabelValues("unauthenticated").Inc()
+				http.Error(w, authErr.Error(), 401)
+				return
+			}
+			// neither the policy nor the principal's grants can be checked against a call that was not decoded
+			if reason := undecodableRejection(options, principal); reason != "" && r.Method != "OPTIONS" {
+				msg := "thrift calls the mapd-api proxy can not decode are not permitted"
+				if req != nil {
+					msg = req.Method + " is not a thrift method the mapd-api proxy can check, it is not permitted"
+				}
+				log.Printf("rejected undecodable request from %s: %s\n", entry.ClientIP, msg)
+				metricsutil.Rejections.WithLabelValues(reason).Inc()
+				if req != nil {
+					writeThriftException(w, req, msg)
+				} else {
+					http.Error(w, msg, 403)
+				}
+				return
+			}
+			if !limiter.Allow(name, limits.Rate, limits.Burst) {
+				metricsutil.Rejections.WithLabelValues("rate_limit").Inc()
+				rejectLimited(w, nil, options, "rate limit exceeded for "+name)
+				return
+			}
+			release, ok := limiter.Acquire(name, limits.MaxConcurrent)
+			if !ok {
+				metricsutil.Rejections.WithLabelValues("concurrency").Inc()
+				rejectLimited(w, nil, options, "too many concurrent calls for "+name)
+				return
+			}
+			defer release()
+			t = &proxyutil.Transport{RoundTripper: upstream}
+			proxyutil.ReverseProxy(w, r, body, backend.URL, t)
+			return
+		}
+
+		entry.Method = req.Method
+		if query = req.Query(); query != "" {
+			entry.Fingerprint = sqlutil.Fingerprint(query)
+			entry.FingerprintID = sqlutil.FingerprintID(entry.Fingerprint)
+		}
+
+		if authErr != nil {
+			log.Printf("rejected %s from %s: %s\n", req.Method, entry.ClientIP, authErr.Error())
+			metricsutil.Rejections.WithLabelValues("unauthenticated").Inc()
+			writeThriftException(w, req, authErr.Error())
+			return
+		}
+
+		route := dispatcher.Route(req.Method)
+		if route.Deny {
+			writeThriftException(w, req, req.Method+" is not permitted through the mapd-api proxy")
+			return
+		}
+		if err := options.policy.Check(req); err != nil {
+			log.Printf("rejected %s from %s: %s\n", req.Method, entry.ClientIP, err.Error())
+			metricsutil.Rejections.WithLabelValues("policy").Inc()
+			writeThriftException(w, req, err.Error())
+			return
+		}
+		user, db := options.user, options.db
+		var cs *mapdutil.ClientSession
+		impersonate := principal != nil && principal.User != ""
+		if route.InjectSession && options.sessionMode == clientSessions {
+			var ok bool
+			if cs, ok = sessions.Lookup(req.Session()); !ok {
+				writeThriftException(w, req, "Session not valid.")
+				return
+			}
+			user, db = cs.User, cs.DB
+			if impersonate && principal.User != cs.User {
+				metricsutil.Rejections.WithLabelValues("forbidden").Inc()
+				writeThriftException(w, req, principal.Name+" may only connect as "+principal.User)
+				return
+			}
+		} else if route.InjectSession && impersonate {
+			user = principal.User
+			if len(principal.Databases) > 0 {
+				db = principal.Databases[0]
+			}
+		}
+		if err := principal.Authorize(req, db); err != nil {
+			log.Printf("rejected %s from %s: %s\n", req.Method, entry.ClientIP, err.Error())
+			metricsutil.Rejections.WithLabelValues("forbidden").Inc()
+			writeThriftException(w, req, err.Error())
+			return
+		}
+		// calls that may be answered from the cache are only counted once they miss it when cache hits are exempt
+		allow := func() bool {
+			if limiter.Allow(name, limits.Rate, limits.Burst) {
+				return true
 			}
+			log.Printf("rejected %s from %s: rate limit exceeded for %s\n", req.Method, entry.ClientIP, name)
+			metricsutil.Rejections.WithLabelValues("rate_limit").Inc()
+			rejectLimited(w, req, options, "rate limit exceeded for "+name)
+			return false
+		}
+		if !options.limitExemptCacheHits && !allow() {
+			return
+		}
+		if err := principal.FilterRows(req); err != nil {
+			log.Printf("rejected %s from %s: %s\n", req.Method, entry.ClientIP, err.Error())
+			metricsutil.Rejections.WithLabelValues("forbidden").Inc()
+			writeThriftException(w, req, err.Error())
+			return
+		}
+
+		if route.InjectSession && cs == nil && impersonate {
+			pwd, ok := options.impersonate[principal.User]
+			if !ok {
+				log.Printf("rejected %s from %s: no -impersonate-pass-file for user %s\n", req.Method, entry.ClientIP, principal.User)
+				metricsutil.Rejections.WithLabelValues("forbidden").Inc()
+				writeThriftException(w, req, "user "+principal.User+" can not be impersonated through the mapd-api proxy")
+				return
+			}
+			cs = sessions.Impersonate(user, pwd, db)
+		}
 
-			result, err := redisutil.Get(cache, query)
+		var reconnect func(stale mapd.TSessionId) (mapd.TSessionId, error)
+		if route.InjectSession && cs == nil {
+			req.SetSession(conn.CurrentSession())
+			reconnect = conn.Reconnect
+		} else if route.InjectSession {
+			session, err := sessions.BackendSession(cs, backend)
 			if err != nil {
-				mb := replaceSession(b, sessionID)
-				t := &proxyutil.Transport{RoundTripper: http.DefaultTransport, Key: query, Pool: cache}
-				proxyutil.ReverseProxy(w, r, []byte(mb), options.url, t)
-			} else {
-				w.Header().Set("Access-Control-Allow-Origin", "*")
-				w.Header().Set("Content-Type", "application/x-thrift")
-				fmt.Fprintln(w, string(result))
+				writeThriftException(w, req, exceptionMessage(err))
+				return
+			}
+			req.SetSession(session)
+			reconnect = func(stale mapd.TSessionId) (mapd.TSessionId, error) {
+				return sessions.Reconnect(cs, backend, stale)
+			}
+		}
+		entry.User = user
+		if route.Serves(req) {
+			route.Handler.ServeThrift(w, r, req)
+			return
+		}
+
+		mb, err := req.Encode()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		if route.Invalidate {
+			defer invalidateWrites(cache, req)
+		}
+
+		t = &proxyutil.Transport{RoundTripper: upstream, Pool: cache, Request: req, Reconnect: reconnect}
+		// forward send the call to mapd-core if its client is within its limits
+		forward := func() {
+			if options.limitExemptCacheHits && !allow() {
+				return
+			}
+			release, ok := limiter.Acquire(name, limits.MaxConcurrent)
+			if !ok {
+				log.Printf("rejected %s from %s: too many concurrent calls for %s\n", req.Method, entry.ClientIP, name)
+				metricsutil.Rejections.WithLabelValues("concurrency").Inc()
+				rejectLimited(w, req, options, "too many concurrent calls for "+name)
+				return
+			}
+			defer release()
+			proxyutil.ReverseProxy(w, r, mb, backend.URL, t)
+		}
+
+		key, ok := cacheKey(req, conn.CurrentVersion(), user, db, principal)
+		if !route.Cache || !ok {
+			forward()
+			return
+		}
+
+		if result, err := redisutil.Get(cache, key.String()); err == nil {
+			reply, err := stampCachedReply(req, result)
+			if err == nil {
+				entry.Cache = "hit"
+				metricsutil.CacheHits.Inc()
+				proxyutil.WriteThrift(w, reply)
+				return
 			}
-		} else if strings.Contains(b, "get_table_details") {
-			mb := replaceSession(b, sessionID)
-			proxyutil.ReverseProxy(w, r, []byte(mb), options.url, nil)
-		} else {
-			proxyutil.ReverseProxy(w, r, []byte(b), options.url, nil)
+			log.Println("ignoring unreadable cached response: " + err.Error())
+		}
+		entry.Cache = "miss"
+		metricsutil.CacheMisses.Inc()
+		t.Key = key.String()
+		t.Tables = sqlutil.Tables(key.Query)
+		// the ttl patterns are written against the client's query, not one rewritten with row filters
+		t.TTL = options.cachePolicy.TTL(sqlutil.NormalizeQuery(query), t.Tables)
+		forward()
+	}
+}
+
+// undecodableRejection the reason a call the proxy could not decode is rejected for, empty if it may be forwarded
+// unchecked because neither the policy nor the principal restricts anything
+func undecodableRejection(options opts, principal *authutil.Principal) string {
+	if options.policy.Restricts() {
+		return "policy"
+	}
+	if principal.Restricted() {
+		return "forbidden"
+	}
+	return ""
+}
+
+// clientLimits the name a caller's calls are limited under and its limits. A principal's own limits replace those
+// of the flags when callers are limited by principal, callers without a principal are always limited by ip.
+func clientLimits(options opts, principal *authutil.Principal, ip string) (string, ratelimitutil.Limits) {
+	limits := ratelimitutil.Limits{Rate: options.rateLimit, Burst: options.rateBurst, MaxConcurrent: options.maxConcurrent}
+	if principal == nil || options.limitBy == limitByIP {
+		return "ip:" + ip, limits
+	}
+	if principal.RateLimit > 0 {
+		limits.Rate, limits.Burst = principal.RateLimit, principal.Burst
+	}
+	if principal.MaxConcurrent > 0 {
+		limits.MaxConcurrent = principal.MaxConcurrent
+	}
+	return principal.Source + ":" + principal.Name, limits
+}
+
+// rejectLimited answer a call over its client's limits with a thrift exception, or a 429 if -limit-response is http
+// or the call could not be decoded
+func rejectLimited(w http.ResponseWriter, req *thriftutil.Request, options opts, msg string) {
+	if req != nil && options.limitResponse == limitThrift {
+		writeThriftException(w, req, msg)
+		return
+	}
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, msg, 429)
+}
+
+// authenticate the principal of the bearer token or api key the request carries, nil if it carries neither and
+// neither is required. A bearer token is only looked at when tokens are verified.
+func authenticate(r *http.Request, cache *redis.Pool, options opts) (*authutil.Principal, error) {
+	if token := authutil.RequestToken(r); token != "" && options.verifier != nil {
+		return options.verifier.Verify(token)
+	}
+	key := authutil.RequestKey(r)
+	if key == "" {
+		if options.requireAPIKey {
+			return nil, errors.New("an api key or bearer token is required")
+		}
+		return nil, nil
+	}
+	var store *redis.Pool
+	if options.apiKeyRedis {
+		store = cache
+	}
+	principal, err := authutil.Lookup(options.apiKeys, store, key)
+	if err != nil && err != authutil.ErrUnknownKey {
+		log.Println("failed to look up api key: " + err.Error())
+		return nil, errors.New("failed to check the api key")
+	}
+	return principal, err
+}
+
+// requestLog where a served request is recorded
+type requestLog struct {
+	access        *logutil.AccessLog
+	slow          *logutil.AccessLog
+	slowThreshold time.Duration
+	queries       *statsutil.Window
+}
+
+// record write the request to the access log, add it to the query statistics and write it with its query to the
+// slow query log if it took longer than the threshold
+func (l *requestLog) record(entry logutil.Entry, query string) {
+	l.access.Log(entry)
+	if entry.Fingerprint == "" {
+		return
+	}
+	l.queries.Record(entry.FingerprintID, entry.Fingerprint, entry.DurationMs, entry.ExecutionTimeMs, entry.Cache)
+	if l.slowThreshold > 0 && entry.DurationMs >= logutil.Milliseconds(l.slowThreshold) {
+		entry.Query = query
+		l.slow.Log(entry)
+	}
+}
+
+// topQueries report the statistics of the queries in the rolling window, n limits the number of queries
+// and sort orders them by count, total, p50, p95 or max
+func topQueries(queries *statsutil.Window) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := 20
+		if v := r.URL.Query().Get("n"); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil || i < 0 {
+				http.Error(w, "invalid n parameter", 400)
+				return
+			}
+			n = i
+		}
+		by := r.URL.Query().Get("sort")
+		if by == "" {
+			by = statsutil.ByTotal
+		}
+		if !statsutil.ValidSort(by) {
+			http.Error(w, "invalid sort parameter", 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"window":  queries.Duration().String(),
+			"sort":    by,
+			"queries": queries.Top(n, by),
+		})
+	}
+}
+
+// clientIP the address of the client that sent the request, without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// invalidateWrites purge cached responses for the tables a query with a write statement or a data load touched
+func invalidateWrites(cache *redis.Pool, req *thriftutil.Request) {
+	var tables []string
+	switch args := req.Args.(type) {
+	case *mapd.MapDSqlExecuteArgs:
+		if !sqlutil.IsWrite(args.Query) {
+			return
+		}
+		tables = sqlutil.Tables(args.Query)
+	case *mapd.MapDInsertDataArgs:
+		// insert_data only carries a table id, so every table is treated as written to
+		n, err := cacheutil.InvalidateAll(cache)
+		if err != nil {
+			log.Println("failed to invalidate cache: " + err.Error())
+			return
+		}
+		log.Printf("%s: invalidated %d cached keys\n", req.Method, n)
+		return
+	default:
+		if name := req.TableName(); name != "" {
+			tables = []string{name}
+		}
+	}
+	for _, table := range tables {
+		n, err := cacheutil.InvalidateTable(cache, table)
+		if err != nil {
+			log.Printf("failed to invalidate cache for table %s: %s\n", table, err.Error())
+			continue
+		}
+		log.Printf("%s: invalidated %d cached responses for table %s\n", req.Method, n, table)
+	}
+}
+
+// stampCachedReply give a cached reply the nonce and sequence id of the request it is answering,
+// clients use them to match responses to requests
+func stampCachedReply(req *thriftutil.Request, cached []byte) ([]byte, error) {
+	resp, err := thriftutil.DecodeResponse(cached)
+	if err != nil {
+		return nil, err
+	}
+	resp.SeqID = req.SeqID
+	resp.SetNonce(req.Nonce())
+	return resp.Encode()
+}
+
+// cacheKey the key a cacheable request is stored under, false if the request can not be cached. The responses of a
+// principal with row filters are only shared with that principal.
+func cacheKey(req *thriftutil.Request, version string, user string, db string, principal *authutil.Principal) (cacheutil.Key, bool) {
+	switch args := req.Args.(type) {
+	case *mapd.MapDSqlExecuteArgs:
+		if !sqlutil.IsSelect(args.Query) {
+			return cacheutil.Key{}, false
+		}
+		key := cacheutil.NewKey(db, user, req.Method, args.Query, args.ColumnFormat, args.FirstN, version)
+		if principal != nil && len(principal.RowFilters) > 0 {
+			key.Principal = principal.Source + ":" + principal.Name
+		}
+		return key, true
+	}
+	return cacheutil.Key{}, false
+}
+
+// sharedDisconnect whether a disconnect targets the shared session, or no session at all, rather than a session
+// the client opened with a forwarded connect and must be able to close
+func sharedDisconnect(pool *mapdutil.BackendPool) func(req *thriftutil.Request) bool {
+	return func(req *thriftutil.Request) bool {
+		return req.Session() == "" || pool.SharedSession(req.Session())
+	}
+}
+
+// handleDisconnect acknowledge disconnects locally so that clients can not close the shared session
+func handleDisconnect(w http.ResponseWriter, r *http.Request, req *thriftutil.Request) {
+	reply, err := req.EncodeReply(mapd.NewMapDDisconnectResult())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	proxyutil.WriteThrift(w, reply)
+}
+
+// handleClientConnect authenticate the client's user against mapd-core and reply with a proxy token in place of
+// the mapd session
+func handleClientConnect(pool *mapdutil.BackendPool, sessions *mapdutil.SessionStore) dispatchutil.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, req *thriftutil.Request) {
+		args := req.Args.(*mapd.MapDConnectArgs)
+		backend, err := pool.Next()
+		if err != nil {
+			writeThriftException(w, req, err.Error())
+			return
+		}
+		token, err := sessions.Open(backend, args.User, args.Passwd, args.Dbname)
+		if err != nil {
+			writeThriftException(w, req, exceptionMessage(err))
+			return
+		}
+		reply, err := req.EncodeReply(&mapd.MapDConnectResult{Success: &token})
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		proxyutil.WriteThrift(w, reply)
+	}
+}
+
+// handleClientDisconnect forget the client's proxy token and close its mapd sessions
+func handleClientDisconnect(sessions *mapdutil.SessionStore) dispatchutil.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, req *thriftutil.Request) {
+		sessions.Close(req.Session())
+		handleDisconnect(w, r, req)
+	}
+}
+
+// exceptionMessage the message mapd-core gave for an error so it can be passed on to the client unwrapped
+func exceptionMessage(err error) string {
+	if e, ok := err.(*mapd.TMapDException); ok {
+		return e.ErrorMsg
+	}
+	return err.Error()
+}
+
+func writeThriftException(w http.ResponseWriter, req *thriftutil.Request, msg string) {
+	reply, err := req.EncodeException(msg)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	proxyutil.WriteThrift(w, reply)
+}
+
+// invalidateCache delete every cached response that references the table given by the table query parameter
+func invalidateCache(cache *redis.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		table := r.URL.Query().Get("table")
+		if table == "" {
+			http.Error(w, "missing table parameter", 400)
+			return
 		}
+		n, err := cacheutil.InvalidateTable(cache, table)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		log.Printf("invalidated %d cached responses for table %s\n", n, table)
+		json.NewEncoder(w).Encode(map[string]interface{}{"table": table, "invalidated": n})
 	}
 }
 
-func getSQLQuery(s string) (string, error){
-	re := regexp.MustCompile(`(.*,"2":{"str":")(.*)("},"3".*)`)
-	m := re.FindStringSubmatch(s)
-	if m == nil || len(m) != 4 {
-		return "", errors.New("Could not find SQL query in body of request")
+// liveness the process is up and serving http
+func liveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, `{"status":"ok"}`)
+}
+
+// redisCheck the redis pool readiness checks, nil if no redis is configured
+func redisCheck(cache *redis.Pool, address string) *redis.Pool {
+	if address == "" {
+		return nil
 	}
-	return m[2], nil
+	return cache
 }
 
-func replaceSession(s string, sessionID string) string {
-	re := regexp.MustCompile(`(.*{"str":")(\w{32})(.*)`)
-	repl := fmt.Sprintf("${1}%s${3}", sessionID)
-	return re.ReplaceAllString(s, repl)
+// readiness check every dependency the proxy needs to serve requests, 503 if it can not or it is shutting down
+func readiness(pool *mapdutil.BackendPool, cache *redis.Pool, draining *int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := healthutil.Report{Checks: []healthutil.Check{{Name: "shutdown", Error: "draining in-flight requests"}}}
+		if atomic.LoadInt32(draining) == 0 {
+			report = healthutil.Readiness(pool, cache)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !report.Ready {
+			w.WriteHeader(503)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
 }
 
-func healthCheck(conn *mapdutil.MapDConn) http.HandlerFunc {
+func healthCheck(pool *mapdutil.BackendPool) http.HandlerFunc {
 	handleError := func(w http.ResponseWriter, err error) error {
 		if err != nil {
 			http.Error(w, err.Error(), 500)
@@ -119,8 +796,11 @@ func healthCheck(conn *mapdutil.MapDConn) http.HandlerFunc {
 	}
 
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		conn.Mu.Lock()
-		info, err := mapdutil.ConnectionInfo(conn)
+		backend, err := pool.Next()
+		if handleError(w, err) != nil {
+			return
+		}
+		info, err := backend.Conn().ServerInfo()
 		if handleError(w, err) != nil {
 			return
 		}
@@ -128,50 +808,734 @@ func healthCheck(conn *mapdutil.MapDConn) http.HandlerFunc {
 		if handleError(w, err) != nil {
 			return
 		}
-		conn.Mu.Unlock()
 		fmt.Fprintln(w, string(jInfo))
 		log.Println("Healthcheck passed - " + string(jInfo))
 	}
 	return http.HandlerFunc(fn)
 }
 
-func sigHandler(conn *mapdutil.MapDConn, cache *redis.Pool) {
+// liveOptions the options in effect, replaced when the configuration is reloaded
+type liveOptions struct {
+	v atomic.Value
+}
+
+func (l *liveOptions) Load() opts {
+	return l.v.Load().(opts)
+}
+
+func (l *liveOptions) Store(o opts) {
+	l.v.Store(o)
+}
+
+// reloadableSettings the flags whose changes are applied on SIGHUP, changing any other flag needs a restart
+var reloadableSettings = map[string]bool{
+	"url":                     true,
+	"balance":                 true,
+	"cache-ttl":               true,
+	"cache-table-ttl":         true,
+	"cache-pattern-ttl":       true,
+	"read-only":               true,
+	"allow-method":            true,
+	"deny-method":             true,
+	"allow-statement":         true,
+	"deny-statement":          true,
+	"allow-query":             true,
+	"allow-fingerprint":       true,
+	"api-key":                 true,
+	"api-key-redis":           true,
+	"require-api-key":         true,
+	"jwt-jwks":                true,
+	"jwt-key":                 true,
+	"jwt-audience":            true,
+	"jwt-issuer":              true,
+	"jwt-leeway":              true,
+	"jwt-claim":               true,
+	"jwt-row-filter":          true,
+	"rate-limit":              true,
+	"rate-burst":              true,
+	"max-concurrent":          true,
+	"limit-by":                true,
+	"limit-response":          true,
+	"limit-exempt-cache-hits": true,
+}
+
+// reloadHandler re-read the config file on SIGHUP and apply the settings that can change without a restart, the
+// command line and environment of the process stay as they were
+func reloadHandler(live *liveOptions, pool *mapdutil.BackendPool) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			log.Println("reloading configuration")
+			if err := reload(live, pool); err != nil {
+				log.Println("failed to reload configuration, keeping the current configuration: " + err.Error())
+			}
+		}
+	}()
+}
+
+func reload(live *liveOptions, pool *mapdutil.BackendPool) error {
+	next, err := options(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	current := live.Load()
+	applied := current
+	applied.settings = make(map[string]string)
+	for name, value := range current.settings {
+		applied.settings[name] = value
+	}
+
+	changed := false
+	for _, name := range changedSettings(current.settings, next.settings) {
+		if !reloadableSettings[name] {
+			log.Printf("config: %s changed from %s to %s, restart to apply it\n", name, display(name, current.settings[name]), display(name, next.settings[name]))
+			continue
+		}
+		log.Printf("config: %s changed from %s to %s\n", name, display(name, current.settings[name]), display(name, next.settings[name]))
+		applied.settings[name] = next.settings[name]
+		changed = true
+	}
+	// the token keys are read from their files again so that they can be rotated without a change of settings
+	if next.verifier != nil {
+		changed = true
+	}
+	if !changed {
+		log.Println("configuration reloaded, nothing to apply")
+		return nil
+	}
+
+	if applied.settings["url"] != current.settings["url"] {
+		if err := pool.SetBackends(next.urls); err != nil {
+			return err
+		}
+		applied.urls = next.urls
+	}
+	if applied.settings["balance"] != current.settings["balance"] {
+		if err := pool.SetStrategy(next.balance); err != nil {
+			return err
+		}
+		applied.balance = next.balance
+	}
+	applied.cachePolicy = next.cachePolicy
+	applied.policy = next.policy
+	applied.apiKeys = next.apiKeys
+	applied.apiKeyRedis = next.apiKeyRedis
+	applied.requireAPIKey = next.requireAPIKey
+	applied.verifier = next.verifier
+	applied.rateLimit = next.rateLimit
+	applied.rateBurst = next.rateBurst
+	applied.maxConcurrent = next.maxConcurrent
+	applied.limitBy = next.limitBy
+	applied.limitResponse = next.limitResponse
+	applied.limitExemptCacheHits = next.limitExemptCacheHits
+	live.Store(applied)
+	log.Println("configuration reloaded")
+	return nil
+}
+
+// display quote a setting for the log, secrets are masked
+func display(name string, value string) string {
+	if (name == "pass" || name == "api-key") && value != "" {
+		return `"******"`
+	}
+	return strconv.Quote(value)
+}
+
+// changedSettings the names of the settings whose value differs, sorted
+func changedSettings(current map[string]string, next map[string]string) []string {
+	var names []string
+	for name, value := range next {
+		if current[name] != value {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// upstreamTransport the transport for every connection to the mapd-core servers, both proxied requests and the
+// api's own calls
+func upstreamTransport(options opts) (*http.Transport, error) {
+	tlsConfig, err := tlsutil.ClientConfig(options.upstreamCA, options.upstreamCert, options.upstreamKey, options.upstreamServerName)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: options.upstreamConnectTimeout, KeepAlive: 30 * time.Second}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   options.upstreamConnectTimeout,
+		ResponseHeaderTimeout: options.upstreamTimeout,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}, nil
+}
+
+// serveAdmin serve the admin endpoints over http on their own address until the server is closed
+func serveAdmin(addr string, handler http.Handler) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: handler}
+	go func() {
+		if err := server.Serve(ln); err != http.ErrServerClosed {
+			log.Println("failed to serve admin http: " + err.Error())
+		}
+	}()
+	return server, nil
+}
+
+// listen serve https when the server has a tls config, http otherwise
+func listen(server *http.Server) error {
+	if server.TLSConfig != nil {
+		// the certificate comes from TLSConfig.GetCertificate
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// sigHandler on SIGINT or SIGTERM fail readiness, keep serving for drainDelay so that load balancers see it and
+// stop sending requests, then stop accepting connections and wait up to drainTimeout for in-flight requests to
+// finish. A second signal exits immediately.
+func sigHandler(server *http.Server, drainDelay time.Duration, drainTimeout time.Duration, draining *int32) <-chan error {
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	drained := make(chan error, 1)
 	go func() {
 		sig := <-c
 		log.Println("Terminating due to signal: ", sig.String())
-		conn.Client.Disconnect(conn.Session)
-		conn.Client.Transport.Close()
-		cache.Close()
-		os.Exit(1)
+		atomic.StoreInt32(draining, 1)
+		go func() {
+			sig := <-c
+			log.Println("Terminating immediately due to second signal: ", sig.String())
+			os.Exit(1)
+		}()
+		time.Sleep(drainDelay)
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		drained <- server.Shutdown(ctx)
 	}()
+	return drained
 }
 
-func options() (opts, error) {
-	var mapdURL string
+// options read the options from the command line, MAPD_API_* environment variables and the -config file
+func options(args []string) (opts, error) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	var configPath string
+	var mapdPwdFile string
+	var mapdURLs string
+	var balance string
+	var healthInterval time.Duration
 	var mapdUser string
 	var mapdDb string
 	var mapdPwd string
 	var httpPort int
+	var adminAddr string
 	var bufferSize int
+	var clientPoolSize int
 	var redisAddress string
-	flag.StringVar(&mapdURL, "url", "http://127.0.0.1:80", "url to mapd-core server")
-	flag.StringVar(&mapdUser, "user", "mapd", "mapd user")
-	flag.StringVar(&mapdDb, "db", "mapd", "mapd database")
-	flag.StringVar(&mapdPwd, "pass", "HyperInteractive", "mapd pwd")
-	flag.IntVar(&httpPort, "http-port", 4000, "port to listen to incoming http connections")
-	flag.IntVar(&bufferSize, "b", 8192, "thrift transport buffer size")
-	flag.StringVar(&redisAddress, "redis", "localhost:6379", "TCP address of redis, if empty no cache is used")
-
-	flag.Usage = func() {
+	var cacheTTL time.Duration
+	var sessionMode string
+	var sessionIdle time.Duration
+	var accessLog string
+	var accessLogFormat string
+	var slowQueryLog string
+	var slowQueryThreshold time.Duration
+	var queryWindow time.Duration
+	var drainDelay time.Duration
+	var drainTimeout time.Duration
+	var tlsCert string
+	var tlsKey string
+	var tlsClientCA string
+	var tlsClientAuth string
+	var upstreamCA string
+	var upstreamCert string
+	var upstreamKey string
+	var upstreamServerName string
+	var upstreamConnectTimeout time.Duration
+	var upstreamTimeout time.Duration
+	var readOnly bool
+	allowMethods := setFlag{}
+	denyMethods := setFlag{}
+	allowStatements := setFlag{}
+	denyStatements := setFlag{}
+	var allowQueries listFlag
+	var allowFingerprints listFlag
+	var apiKeys apiKeyFlag
+	var apiKeyRedis bool
+	var requireAPIKey bool
+	var jwtJWKS listFlag
+	var jwtKeys listFlag
+	var jwtAudience string
+	var jwtIssuer string
+	var jwtLeeway time.Duration
+	jwtClaims := mapFlag{}
+	jwtRowFilters := mapFlag{}
+	impersonatePassFiles := mapFlag{}
+	var rateLimit float64
+	var rateBurst int
+	var maxConcurrent int
+	var limitBy string
+	var limitRedis bool
+	var limitResponse string
+	var limitExemptCacheHits bool
+	tableTTLs := tableTTLFlag{}
+	var patternTTLs patternTTLFlag
+	fs.StringVar(&configPath, "config", "", "yaml config file, every flag can be set in it under its name")
+	fs.StringVar(&mapdURLs, "url", "http://127.0.0.1:80", "url to mapd-core server, a comma separated list balances over several servers")
+	fs.StringVar(&balance, "balance", mapdutil.RoundRobin, "how requests are balanced over mapd-core servers: round-robin or least-outstanding")
+	fs.DurationVar(&healthInterval, "health-interval", 5*time.Second, "how often mapd-core servers are checked to eject or re-admit them")
+	fs.StringVar(&mapdUser, "user", "mapd", "mapd user")
+	fs.StringVar(&mapdDb, "db", "mapd", "mapd database")
+	fs.StringVar(&mapdPwd, "pass", "HyperInteractive", "mapd pwd")
+	fs.StringVar(&mapdPwdFile, "pass-file", "", "file to read the mapd pwd from, overrides -pass")
+	fs.StringVar(&upstreamCA, "upstream-ca", "", "ca bundle that https mapd-core servers are verified against, the system roots if empty")
+	fs.StringVar(&upstreamCert, "upstream-cert", "", "client certificate file presented to https mapd-core servers")
+	fs.StringVar(&upstreamKey, "upstream-key", "", "private key file of -upstream-cert")
+	fs.StringVar(&upstreamServerName, "upstream-server-name", "", "name the certificates of https mapd-core servers are checked against, the url host if empty")
+	fs.DurationVar(&upstreamConnectTimeout, "upstream-connect-timeout", 10*time.Second, "how long connecting to a mapd-core server, including the tls handshake, may take")
+	fs.DurationVar(&upstreamTimeout, "upstream-timeout", 0, "how long to wait for mapd-core to answer a request, 0 waits indefinitely")
+	fs.StringVar(&sessionMode, "session-mode", sharedSessions, "shared proxies every client with the -user session, client proxies every client with a session for the user it connected as; client tokens are only known to the instance that issued them")
+	fs.DurationVar(&sessionIdle, "session-idle", 24*time.Hour, "how long an unused client session is kept in client session mode")
+	fs.IntVar(&httpPort, "http-port", 4000, "port to listen to incoming http connections")
+	fs.StringVar(&adminAddr, "admin-addr", "localhost:4001", "address the admin endpoints are served on over http, keep it private; empty disables them")
+	fs.StringVar(&tlsCert, "tls-cert", "", "certificate file to serve https with, reloaded when it changes")
+	fs.StringVar(&tlsKey, "tls-key", "", "private key file of -tls-cert")
+	fs.StringVar(&tlsClientCA, "tls-client-ca", "", "ca bundle that client certificates are verified against")
+	fs.StringVar(&tlsClientAuth, "tls-client-auth", tlsutil.NoClientCert, "client certificates: none, verify-if-given or require")
+	fs.DurationVar(&drainDelay, "drain-delay", 10*time.Second, "how long readiness fails on shutdown before connections stop being accepted, longer than the load balancer's probe interval")
+	fs.DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "how long in-flight requests are given to finish on shutdown")
+	fs.IntVar(&bufferSize, "b", 8192, "thrift transport buffer size")
+	fs.IntVar(&clientPoolSize, "client-pool-size", 4, "number of thrift clients per mapd-core server for calls made by the api itself")
+	fs.StringVar(&redisAddress, "redis", "localhost:6379", "TCP address of redis, if empty no cache is used")
+	fs.DurationVar(&cacheTTL, "cache-ttl", time.Hour, "default ttl of cached responses, 0 never expires")
+	fs.Var(tableTTLs, "cache-table-ttl", "ttl of cached responses that reference a table as table=duration, can be repeated")
+	fs.Var(&patternTTLs, "cache-pattern-ttl", "ttl of cached responses whose query matches a regexp as regexp=duration, can be repeated")
+	fs.BoolVar(&readOnly, "read-only", false, "reject every statement and method that writes data, dashboards or server state")
+	fs.Var(allowMethods, "allow-method", "only permit these thrift methods, comma separated, can be repeated")
+	fs.Var(denyMethods, "deny-method", "reject these thrift methods, comma separated, can be repeated")
+	fs.Var(allowStatements, "allow-statement", "only permit these sql statement types e.g. SELECT, comma separated, can be repeated")
+	fs.Var(denyStatements, "deny-statement", "reject these sql statement types e.g. DROP, comma separated, can be repeated")
+	fs.Var(&allowQueries, "allow-query", "only permit queries that match one of these regexps or -allow-fingerprint, can be repeated")
+	fs.Var(&allowFingerprints, "allow-fingerprint", "only permit queries with one of these fingerprints, given as an id or a query, or that match -allow-query, can be repeated")
+	fs.Var(&apiKeys, "api-key", "api key as a json object with name, key or key_sha256, user, databases, methods, tables, row_filters, rate_limit, burst and max_concurrent, can be repeated")
+	fs.BoolVar(&apiKeyRedis, "api-key-redis", false, "also look api keys up in redis under mapd-api:apikey:<sha256 of the key>")
+	fs.BoolVar(&requireAPIKey, "require-api-key", false, "reject requests without an api key in the X-API-Key header or the api_key query parameter, or a bearer token when tokens are verified")
+	fs.Var(&jwtJWKS, "jwt-jwks", "json web key set file that bearer tokens are verified against, can be repeated")
+	fs.Var(&jwtKeys, "jwt-key", "pem rsa or ecdsa public key or certificate file that bearer tokens are verified against, can be repeated")
+	fs.StringVar(&jwtAudience, "jwt-audience", "", "audience bearer tokens must be issued for, required to verify tokens")
+	fs.StringVar(&jwtIssuer, "jwt-issuer", "", "issuer bearer tokens must come from, any if empty")
+	fs.DurationVar(&jwtLeeway, "jwt-leeway", 30*time.Second, "clock skew allowed when checking the expiry of bearer tokens")
+	fs.Var(jwtClaims, "jwt-claim", "claim a principal field is read from as field=claim, fields are name, databases, methods, tables and user, can be repeated")
+	fs.Var(jwtRowFilters, "jwt-row-filter", "predicate that restricts the rows of a table bearer token callers read as table=predicate, {claim} is replaced with the claim's value, can be repeated")
+	fs.Var(impersonatePassFiles, "impersonate-pass-file", "file to read the pwd of a mapd user that principals may be mapped to as user=file, can be repeated")
+	fs.Float64Var(&rateLimit, "rate-limit", 0, "calls per second each client may make, 0 is unlimited; an api key's rate_limit replaces it")
+	fs.IntVar(&rateBurst, "rate-burst", 0, "calls each client may make at once above -rate-limit, -rate-limit rounded up if 0")
+	fs.IntVar(&maxConcurrent, "max-concurrent", 0, "calls each client may have running on mapd-core at once, 0 is unlimited; an api key's max_concurrent replaces it")
+	fs.StringVar(&limitBy, "limit-by", limitByPrincipal, "what a client is for -rate-limit and -max-concurrent: principal, the api key or token subject and otherwise the ip, or ip")
+	fs.BoolVar(&limitRedis, "limit-redis", false, "share rate limits and concurrency caps with every instance using the same redis, falling back to limits per instance while redis is unreachable")
+	fs.StringVar(&limitResponse, "limit-response", limitThrift, "how calls over their client's limits are rejected: thrift for a thrift exception or http for a 429")
+	fs.BoolVar(&limitExemptCacheHits, "limit-exempt-cache-hits", false, "do not count calls answered from the cache against -rate-limit")
+	fs.StringVar(&accessLog, "access-log", "stdout", "where the access log is written: stdout, stderr or a file path, empty disables it")
+	fs.StringVar(&accessLogFormat, "access-log-format", logutil.JSON, "access log format: json or text")
+	fs.StringVar(&slowQueryLog, "slow-query-log", "", "where queries slower than -slow-query-threshold are written: stdout, stderr or a file path, empty disables it")
+	fs.DurationVar(&slowQueryThreshold, "slow-query-threshold", time.Second, "how long a query may take before it is written to the slow query log")
+	fs.DurationVar(&queryWindow, "query-window", 15*time.Minute, "how far back /admin/queries/top reports")
+
+	fs.Usage = func() {
 		fmt.Printf("Usage of %s:\n", os.Args[0])
-		flag.PrintDefaults()
+		fs.PrintDefaults()
+		fmt.Println("\nEvery flag can also be set with a MAPD_API_ environment variable, e.g. MAPD_API_CACHE_TTL for -cache-ttl. Repeatable flags take one value per line.")
 	}
-	flag.Parse()
-	serverURL, err := url.Parse(mapdURL)
-	if err != nil {
+	if err := configutil.Load(fs, args, envPrefix, "config"); err != nil {
 		return opts{}, err
 	}
-	return opts{serverURL, mapdUser, mapdDb, mapdPwd, httpPort, bufferSize, redisAddress}, nil
+
+	var errs []string
+	invalid := func(name string, format string, a ...interface{}) {
+		errs = append(errs, "-"+name+": "+fmt.Sprintf(format, a...))
+	}
+	if mapdPwdFile != "" {
+		pwd, err := configutil.ReadSecret(mapdPwdFile)
+		if err != nil {
+			invalid("pass-file", "%s", err.Error())
+		}
+		mapdPwd = pwd
+	}
+	var serverURLs []*url.URL
+	for _, u := range strings.Split(mapdURLs, ",") {
+		serverURL, err := url.Parse(strings.TrimSpace(u))
+		if err != nil {
+			invalid("url", "%s", err.Error())
+			continue
+		}
+		if serverURL.Scheme != "http" && serverURL.Scheme != "https" || serverURL.Host == "" {
+			invalid("url", "expected an http or https url, got %q", u)
+			continue
+		}
+		serverURLs = append(serverURLs, serverURL)
+	}
+	if balance != mapdutil.RoundRobin && balance != mapdutil.LeastOutstanding {
+		invalid("balance", "unknown balancing strategy %q", balance)
+	}
+	if sessionMode != sharedSessions && sessionMode != clientSessions {
+		invalid("session-mode", "unknown session mode %q", sessionMode)
+	}
+	if httpPort <= 0 || httpPort > 65535 {
+		invalid("http-port", "%d is not a valid port", httpPort)
+	}
+	if (tlsCert == "") != (tlsKey == "") {
+		invalid("tls-cert", "-tls-cert and -tls-key must be given together")
+	}
+	switch tlsClientAuth {
+	case tlsutil.NoClientCert:
+	case tlsutil.VerifyClientCertIfGiven, tlsutil.RequireClientCert:
+		if tlsClientCA == "" {
+			invalid("tls-client-auth", "%s needs -tls-client-ca", tlsClientAuth)
+		}
+		if tlsCert == "" {
+			invalid("tls-client-auth", "%s needs -tls-cert", tlsClientAuth)
+		}
+	default:
+		invalid("tls-client-auth", "unknown client certificate mode %q", tlsClientAuth)
+	}
+	if (upstreamCert == "") != (upstreamKey == "") {
+		invalid("upstream-cert", "-upstream-cert and -upstream-key must be given together")
+	}
+	if drainDelay < 0 {
+		invalid("drain-delay", "must not be negative")
+	}
+	if upstreamTimeout < 0 {
+		invalid("upstream-timeout", "must not be negative")
+	}
+	if bufferSize <= 0 {
+		invalid("b", "must be positive")
+	}
+	if clientPoolSize <= 0 {
+		invalid("client-pool-size", "must be positive")
+	}
+	positive := map[string]time.Duration{"health-interval": healthInterval, "session-idle": sessionIdle, "query-window": queryWindow, "drain-timeout": drainTimeout, "upstream-connect-timeout": upstreamConnectTimeout}
+	for name, d := range positive {
+		if d <= 0 {
+			invalid(name, "must be positive")
+		}
+	}
+	if cacheTTL < 0 {
+		invalid("cache-ttl", "must not be negative")
+	}
+	for table, ttl := range tableTTLs {
+		if ttl < 0 {
+			invalid("cache-table-ttl", "ttl of %s must not be negative", table)
+		}
+	}
+	for _, p := range patternTTLs {
+		if p.TTL < 0 {
+			invalid("cache-pattern-ttl", "ttl of %s must not be negative", p.Pattern.String())
+		}
+	}
+	policy := &policyutil.Policy{ReadOnly: readOnly, AllowMethods: allowMethods, DenyMethods: denyMethods, AllowStatements: map[string]bool{}, DenyStatements: map[string]bool{}}
+	known := make(map[string]bool)
+	for _, method := range thriftutil.Methods() {
+		known[method] = true
+	}
+	for name, methods := range map[string]setFlag{"allow-method": allowMethods, "deny-method": denyMethods} {
+		for method := range methods {
+			if !known[method] {
+				invalid(name, "unknown thrift method %q", method)
+			}
+		}
+	}
+	for st := range allowStatements {
+		policy.AllowStatements[strings.ToUpper(st)] = true
+	}
+	for st := range denyStatements {
+		policy.DenyStatements[strings.ToUpper(st)] = true
+	}
+	for _, pattern := range allowQueries {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			invalid("allow-query", "%s", err.Error())
+			continue
+		}
+		policy.QueryPatterns = append(policy.QueryPatterns, re)
+	}
+	for _, fingerprint := range allowFingerprints {
+		policy.AllowFingerprint(fingerprint)
+	}
+	keys := authutil.Keys{}
+	for _, key := range apiKeys {
+		if err := keys.Add(key); err != nil {
+			invalid("api-key", "%s", err.Error())
+		}
+		for _, method := range key.Methods {
+			if !known[method] {
+				invalid("api-key", "api key %s: unknown thrift method %q", key.Name, method)
+			}
+		}
+	}
+	if apiKeyRedis && redisAddress == "" {
+		invalid("api-key-redis", "needs -redis")
+	}
+	var verifier *authutil.Verifier
+	if len(jwtJWKS) > 0 || len(jwtKeys) > 0 {
+		v, err := authutil.NewVerifier(jwtJWKS, jwtKeys)
+		if err != nil {
+			invalid("jwt-jwks", "%s", err.Error())
+		}
+		if jwtAudience == "" {
+			invalid("jwt-audience", "is required to verify bearer tokens")
+		}
+		if v != nil {
+			v.Audience, v.Issuer, v.Leeway, v.Claims, v.RowFilters = jwtAudience, jwtIssuer, jwtLeeway, jwtClaims, jwtRowFilters
+			verifier = v
+		}
+	}
+	for field := range jwtClaims {
+		if _, ok := authutil.DefaultClaims[field]; !ok {
+			invalid("jwt-claim", "unknown principal field %q", field)
+		}
+	}
+	if err := authutil.CheckRowFilters(jwtRowFilters); err != nil {
+		invalid("jwt-row-filter", "%s", err.Error())
+	}
+	if jwtLeeway < 0 {
+		invalid("jwt-leeway", "must not be negative")
+	}
+	impersonate := make(map[string]string)
+	for user, path := range impersonatePassFiles {
+		pwd, err := configutil.ReadSecret(path)
+		if err != nil {
+			invalid("impersonate-pass-file", "%s", err.Error())
+		}
+		impersonate[user] = pwd
+	}
+	if rateLimit < 0 {
+		invalid("rate-limit", "must not be negative")
+	}
+	if rateBurst < 0 {
+		invalid("rate-burst", "must not be negative")
+	}
+	if maxConcurrent < 0 {
+		invalid("max-concurrent", "must not be negative")
+	}
+	if limitBy != limitByPrincipal && limitBy != limitByIP {
+		invalid("limit-by", "unknown client %q", limitBy)
+	}
+	if limitRedis && redisAddress == "" {
+		invalid("limit-redis", "needs -redis")
+	}
+	if limitResponse != limitThrift && limitResponse != limitHTTP {
+		invalid("limit-response", "unknown response %q", limitResponse)
+	}
+	if accessLogFormat != logutil.JSON && accessLogFormat != logutil.Text {
+		invalid("access-log-format", "unknown format %q", accessLogFormat)
+	}
+	if slowQueryThreshold < 0 {
+		invalid("slow-query-threshold", "must not be negative")
+	}
+	if len(errs) > 0 {
+		return opts{}, configutil.Invalid(errs)
+	}
+	settings := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		settings[f.Name] = f.Value.String()
+	})
+	return opts{
+		urls:                   serverURLs,
+		balance:                balance,
+		healthInterval:         healthInterval,
+		user:                   mapdUser,
+		db:                     mapdDb,
+		pwd:                    mapdPwd,
+		httpPort:               httpPort,
+		adminAddr:              adminAddr,
+		bufferSize:             bufferSize,
+		clientPoolSize:         clientPoolSize,
+		redisAddress:           redisAddress,
+		cachePolicy:            cacheutil.Policy{DefaultTTL: cacheTTL, TableTTLs: tableTTLs, PatternTTLs: patternTTLs},
+		sessionMode:            sessionMode,
+		sessionIdle:            sessionIdle,
+		accessLog:              accessLog,
+		accessLogFormat:        accessLogFormat,
+		slowQueryLog:           slowQueryLog,
+		slowQueryThreshold:     slowQueryThreshold,
+		queryWindow:            queryWindow,
+		drainDelay:             drainDelay,
+		drainTimeout:           drainTimeout,
+		tlsCert:                tlsCert,
+		tlsKey:                 tlsKey,
+		tlsClientCA:            tlsClientCA,
+		tlsClientAuth:          tlsClientAuth,
+		upstreamCA:             upstreamCA,
+		upstreamCert:           upstreamCert,
+		upstreamKey:            upstreamKey,
+		upstreamServerName:     upstreamServerName,
+		upstreamConnectTimeout: upstreamConnectTimeout,
+		upstreamTimeout:        upstreamTimeout,
+		policy:                 policy,
+		apiKeys:                keys,
+		apiKeyRedis:            apiKeyRedis,
+		requireAPIKey:          requireAPIKey,
+		verifier:               verifier,
+		impersonate:            impersonate,
+		rateLimit:              rateLimit,
+		rateBurst:              rateBurst,
+		maxConcurrent:          maxConcurrent,
+		limitBy:                limitBy,
+		limitRedis:             limitRedis,
+		limitResponse:          limitResponse,
+		limitExemptCacheHits:   limitExemptCacheHits,
+		settings:               settings,
+	}, nil
+}
+
+// tableTTLFlag repeatable table=duration flag
+type tableTTLFlag map[string]time.Duration
+
+func (f tableTTLFlag) Repeatable() bool { return true }
+
+func (f tableTTLFlag) String() string {
+	var s []string
+	for table, ttl := range f {
+		s = append(s, table+"="+ttl.String())
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (f tableTTLFlag) Set(value string) error {
+	table, ttl, err := splitTTL(value)
+	if err != nil {
+		return err
+	}
+	f[strings.ToLower(table)] = ttl
+	return nil
+}
+
+// patternTTLFlag repeatable regexp=duration flag
+type patternTTLFlag []cacheutil.PatternTTL
+
+func (f *patternTTLFlag) Repeatable() bool { return true }
+
+func (f *patternTTLFlag) String() string {
+	var s []string
+	for _, p := range *f {
+		s = append(s, p.Pattern.String()+"="+p.TTL.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *patternTTLFlag) Set(value string) error {
+	pattern, ttl, err := splitTTL(value)
+	if err != nil {
+		return err
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, cacheutil.PatternTTL{Pattern: re, TTL: ttl})
+	return nil
+}
+
+// setFlag repeatable flag of names, each value may be a comma separated list
+type setFlag map[string]bool
+
+func (f setFlag) Repeatable() bool { return true }
+
+func (f setFlag) String() string {
+	var s []string
+	for name := range f {
+		s = append(s, name)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (f setFlag) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			f[name] = true
+		}
+	}
+	return nil
+}
+
+// listFlag repeatable flag that keeps every value as given
+type listFlag []string
+
+func (f *listFlag) Repeatable() bool { return true }
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// mapFlag repeatable name=value flag
+type mapFlag map[string]string
+
+func (f mapFlag) Repeatable() bool { return true }
+
+func (f mapFlag) String() string {
+	var s []string
+	for name, value := range f {
+		s = append(s, name+"="+value)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (f mapFlag) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected name=value, got %q", value)
+	}
+	f[value[:i]] = value[i+1:]
+	return nil
+}
+
+// apiKeyFlag repeatable flag of api keys, each value a json object or list of objects
+type apiKeyFlag []authutil.Key
+
+func (f *apiKeyFlag) Repeatable() bool { return true }
+
+func (f *apiKeyFlag) Structured() bool { return true }
+
+func (f *apiKeyFlag) String() string {
+	if len(*f) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(*f)
+	return string(b)
+}
+
+func (f *apiKeyFlag) Set(value string) error {
+	keys, err := authutil.ParseKeys(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, keys...)
+	return nil
+}
+
+// splitTTL split name=duration on the last equals sign so that the name may contain one
+func splitTTL(value string) (string, time.Duration, error) {
+	i := strings.LastIndex(value, "=")
+	if i <= 0 {
+		return "", 0, fmt.Errorf("expected name=duration, got %q", value)
+	}
+	ttl, err := time.ParseDuration(value[i+1:])
+	if err != nil {
+		return "", 0, err
+	}
+	return value[:i], ttl, nil
 }
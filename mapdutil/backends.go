@@ -0,0 +1,301 @@
+package mapdutil
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shusson/mapd-api/thrift/e745367/mapd"
+)
+
+// ErrNoHealthyBackend returned when every backend has been ejected
+var ErrNoHealthyBackend = errors.New("no healthy mapd backend")
+
+const (
+	// RoundRobin balance requests over the healthy backends in turn
+	RoundRobin = "round-robin"
+	// LeastOutstanding balance requests to the healthy backend with the fewest requests in flight
+	LeastOutstanding = "least-outstanding"
+)
+
+// Backend a mapd-core server behind the proxy with its own connection and session
+type Backend struct {
+	URL *url.URL
+
+	mu          sync.RWMutex
+	conn        *MapDConn
+	healthy     bool
+	removed     bool
+	outstanding int64
+}
+
+// Conn the connection to the backend, nil until the backend has been reached
+func (b *Backend) Conn() *MapDConn {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.conn
+}
+
+// Healthy whether the backend is admitted to the pool
+func (b *Backend) Healthy() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.healthy
+}
+
+// Outstanding the number of proxied requests in flight to the backend
+func (b *Backend) Outstanding() int64 {
+	return atomic.LoadInt64(&b.outstanding)
+}
+
+// Acquire count a request against the backend, every Acquire must be followed by a Release
+func (b *Backend) Acquire() {
+	atomic.AddInt64(&b.outstanding, 1)
+}
+
+// Release the request counted by Acquire has finished
+func (b *Backend) Release() {
+	atomic.AddInt64(&b.outstanding, -1)
+}
+
+func (b *Backend) setHealthy(healthy bool) {
+	b.mu.Lock()
+	healthy = healthy && !b.removed
+	changed := b.healthy != healthy
+	b.healthy = healthy
+	b.mu.Unlock()
+	if changed && healthy {
+		log.Println("admitting mapd backend: ", b.URL.String())
+	} else if changed {
+		log.Println("ejecting mapd backend: ", b.URL.String())
+	}
+}
+
+// BackendPool a set of mapd-core servers that proxied requests are balanced over
+type BackendPool struct {
+	mu         sync.RWMutex
+	backends   []*Backend
+	strategy   string
+	next       uint64
+	user       string
+	pwd        string
+	db         string
+	bufferSize int
+	poolSize   int
+	httpClient *http.Client
+}
+
+// NewBackendPool connect to every backend, retrying until at least one of them accepts a connection.
+// Backends that could not be reached are admitted by CheckHealth once they come up. The api's own calls to
+// the backends are made with httpClient, or the default client if nil.
+func NewBackendPool(urls []*url.URL, strategy string, user string, pwd string, db string, bufferSize int, poolSize int, httpClient *http.Client, attempts int, sleep time.Duration) (*BackendPool, error) {
+	if err := validStrategy(strategy); err != nil {
+		return nil, err
+	}
+	if len(urls) == 0 {
+		return nil, errors.New("no mapd backends configured")
+	}
+	p := &BackendPool{strategy: strategy, user: user, pwd: pwd, db: db, bufferSize: bufferSize, poolSize: poolSize, httpClient: httpClient}
+	for _, u := range urls {
+		p.backends = append(p.backends, &Backend{URL: u})
+	}
+	for i := 0; i < attempts; i++ {
+		p.checkAll()
+		if len(p.Healthy()) > 0 {
+			return p, nil
+		}
+		time.Sleep(sleep)
+		log.Println("retrying connection to mapd backends")
+	}
+	return nil, ErrNoHealthyBackend
+}
+
+// Backends every backend in the pool, healthy or not
+func (p *BackendPool) Backends() []*Backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]*Backend(nil), p.backends...)
+}
+
+// SharedSession whether the session is the one the api opened on one of the backends
+func (p *BackendPool) SharedSession(session mapd.TSessionId) bool {
+	for _, b := range p.Backends() {
+		if conn := b.Conn(); conn != nil && conn.CurrentSession() == session {
+			return true
+		}
+	}
+	return false
+}
+
+// SetBackends replace the servers of the pool. Backends that are kept keep their connection, new backends are
+// admitted once CheckHealth reaches them and removed backends are disconnected.
+func (p *BackendPool) SetBackends(urls []*url.URL) error {
+	if len(urls) == 0 {
+		return errors.New("no mapd backends configured")
+	}
+	p.mu.Lock()
+	current := make(map[string]*Backend)
+	for _, b := range p.backends {
+		current[b.URL.String()] = b
+	}
+	var backends []*Backend
+	for _, u := range urls {
+		if b, ok := current[u.String()]; ok {
+			backends = append(backends, b)
+			delete(current, u.String())
+			continue
+		}
+		log.Println("adding mapd backend: ", u.String())
+		b := &Backend{URL: u}
+		backends = append(backends, b)
+		go p.check(b)
+	}
+	p.backends = backends
+	p.mu.Unlock()
+
+	for _, b := range current {
+		log.Println("removing mapd backend: ", b.URL.String())
+		b.setHealthy(false)
+		b.mu.Lock()
+		b.removed = true
+		conn := b.conn
+		b.mu.Unlock()
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	return nil
+}
+
+// SetStrategy change how requests are balanced over the backends
+func (p *BackendPool) SetStrategy(strategy string) error {
+	if err := validStrategy(strategy); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.strategy = strategy
+	p.mu.Unlock()
+	return nil
+}
+
+func validStrategy(strategy string) error {
+	if strategy != RoundRobin && strategy != LeastOutstanding {
+		return fmt.Errorf("unknown balancing strategy %q", strategy)
+	}
+	return nil
+}
+
+// Close disconnect the session of every backend
+func (p *BackendPool) Close() {
+	for _, b := range p.Backends() {
+		if conn := b.Conn(); conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+// Healthy the backends currently admitted to the pool
+func (p *BackendPool) Healthy() []*Backend {
+	var healthy []*Backend
+	for _, b := range p.Backends() {
+		if b.Healthy() {
+			healthy = append(healthy, b)
+		}
+	}
+	return healthy
+}
+
+// Next choose the backend for a request with the pool's balancing strategy
+func (p *BackendPool) Next() (*Backend, error) {
+	healthy := p.Healthy()
+	if len(healthy) == 0 {
+		return nil, ErrNoHealthyBackend
+	}
+	p.mu.RLock()
+	strategy := p.strategy
+	p.mu.RUnlock()
+	if strategy == LeastOutstanding {
+		best := healthy[0]
+		for _, b := range healthy[1:] {
+			if b.Outstanding() < best.Outstanding() {
+				best = b
+			}
+		}
+		return best, nil
+	}
+	n := atomic.AddUint64(&p.next, 1)
+	return healthy[(n-1)%uint64(len(healthy))], nil
+}
+
+// CheckHealth poll every backend with GetServerStatus until stop is closed. Backends that fail are ejected
+// and reconnected, backends that recover are admitted again.
+func (p *BackendPool) CheckHealth(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.checkAll()
+		}
+	}
+}
+
+// checkAll check every backend concurrently, connecting the ones that have never been reached
+func (p *BackendPool) checkAll() {
+	var wg sync.WaitGroup
+	for _, b := range p.Backends() {
+		wg.Add(1)
+		go func(b *Backend) {
+			defer wg.Done()
+			p.check(b)
+		}(b)
+	}
+	wg.Wait()
+}
+
+func (p *BackendPool) check(b *Backend) {
+	b.mu.RLock()
+	conn, removed := b.conn, b.removed
+	b.mu.RUnlock()
+	if removed {
+		return
+	}
+	if conn == nil {
+		c, err := ConnectToMapD(p.user, p.pwd, p.db, b.URL.String(), p.bufferSize, p.poolSize, p.httpClient)
+		if err != nil {
+			log.Printf("failed to connect to mapd backend %s: %s\n", b.URL.String(), err.Error())
+			b.setHealthy(false)
+			return
+		}
+		b.mu.Lock()
+		removed := b.removed
+		if !removed {
+			b.conn = c
+		}
+		b.mu.Unlock()
+		if removed {
+			c.Close()
+			return
+		}
+		b.setHealthy(true)
+		return
+	}
+
+	if _, err := conn.ServerInfo(); err == nil {
+		b.setHealthy(true)
+		return
+	}
+	b.setHealthy(false)
+	if _, err := conn.Reconnect(conn.CurrentSession()); err != nil {
+		log.Printf("failed to reconnect to mapd backend %s: %s\n", b.URL.String(), err.Error())
+		return
+	}
+	b.setHealthy(true)
+}
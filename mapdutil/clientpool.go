@@ -0,0 +1,102 @@
+package mapdutil
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/shusson/mapd-api/thrift/e745367/mapd"
+)
+
+// ErrPoolClosed returned when a client is checked out of a closed pool
+var ErrPoolClosed = errors.New("mapd client pool closed")
+
+// ClientPool thrift clients to a single mapd server. A client and its buffered transport are not safe for
+// concurrent use, so each caller checks out a client of its own and checks it back in when done.
+type ClientPool struct {
+	url        string
+	bufferSize int
+	httpClient *http.Client
+	// slots holds a token for every client that may be checked out, Get blocks while the pool is exhausted
+	slots  chan struct{}
+	idle   chan *mapd.MapDClient
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewClientPool construct a pool of at most size clients, clients are opened on demand
+func NewClientPool(url string, bufferSize int, size int, httpClient *http.Client) *ClientPool {
+	if size < 1 {
+		size = 1
+	}
+	return &ClientPool{
+		url:        url,
+		bufferSize: bufferSize,
+		httpClient: httpClient,
+		slots:      make(chan struct{}, size),
+		idle:       make(chan *mapd.MapDClient, size),
+	}
+}
+
+// Get check out a client, waits for one to be checked in if the pool is exhausted
+func (p *ClientPool) Get() (*mapd.MapDClient, error) {
+	p.slots <- struct{}{}
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		<-p.slots
+		return nil, ErrPoolClosed
+	}
+	select {
+	case client := <-p.idle:
+		return client, nil
+	default:
+	}
+	client, err := NewClient(p.url, p.bufferSize, p.httpClient)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return client, nil
+}
+
+// Put check a client back in. A client whose call failed may hold a half written buffer, so it is closed
+// rather than reused, as is a client checked in after the pool was closed.
+func (p *ClientPool) Put(client *mapd.MapDClient, err error) {
+	// the lock is held until the client is idle so that Close can not drain the pool in between
+	p.mu.Lock()
+	if err != nil || p.closed {
+		client.Transport.Close()
+	} else {
+		p.idle <- client
+	}
+	p.mu.Unlock()
+	<-p.slots
+}
+
+// Call run fn with a checked out client
+func (p *ClientPool) Call(fn func(client *mapd.MapDClient) error) error {
+	client, err := p.Get()
+	if err != nil {
+		return err
+	}
+	err = fn(client)
+	p.Put(client, err)
+	return err
+}
+
+// Close close every idle client, clients checked out are closed when they are checked in
+func (p *ClientPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for {
+		select {
+		case client := <-p.idle:
+			client.Transport.Close()
+		default:
+			return
+		}
+	}
+}
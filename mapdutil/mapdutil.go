@@ -2,18 +2,28 @@ package mapdutil
 
 import (
 	"github.com/shusson/mapd-api/thrift/e745367/mapd"
+	"github.com/shusson/mapd-api/metricsutil"
 	"git.apache.org/thrift.git/lib/go/thrift"
 	"log"
+	"net/http"
 	"encoding/json"
-	"time"
 	"sync"
+	"strings"
 )
 
-// MapDConn wrapper around mapd client
+// MapDConn a session with a mapd server and a pool of clients to make calls on it
 type MapDConn struct {
-	Client  *mapd.MapDClient
+	Clients *ClientPool
 	Session mapd.TSessionId
+	Version string
+	// Mu serializes reconnects
 	Mu sync.Mutex
+
+	// sessionMu guards Session and Version so they can be read while the session is being replaced
+	sessionMu sync.RWMutex
+	user      string
+	pwd       string
+	db        string
 }
 
 // MapDConnInfo mapd connection info
@@ -23,11 +33,11 @@ type MapDConnInfo struct {
 	ReadOnly  bool `json:"read_only"`
 }
 
-// ConnectToMapD connect to mapd core server
-func ConnectToMapD(user string, pwd string, db string, url string, bufferSize int) (*MapDConn, error) {
+// NewClient open a thrift client to a mapd core server, calls are made with httpClient or the default client if nil
+func NewClient(url string, bufferSize int, httpClient *http.Client) (*mapd.MapDClient, error) {
 	protocolFactory := thrift.NewTJSONProtocolFactory()
 	transportFactory := thrift.NewTBufferedTransportFactory(bufferSize)
-	socket, err := thrift.NewTHttpPostClient(url)
+	socket, err := thrift.NewTHttpPostClientWithOptions(url, thrift.THttpClientOptions{Client: httpClient})
 	if err != nil {
 		return nil, err
 	}
@@ -38,17 +48,24 @@ func ConnectToMapD(user string, pwd string, db string, url string, bufferSize in
 	if err := transport.Open(); err != nil {
 		return nil, err
 	}
-	client := mapd.NewMapDClientFactory(transport, protocolFactory)
-	sessionID, err := client.Connect(user, pwd, db)
+	return mapd.NewMapDClientFactory(transport, protocolFactory), nil
+}
+
+// ConnectToMapD connect to mapd core server, calls are made with a pool of at most poolSize clients
+func ConnectToMapD(user string, pwd string, db string, url string, bufferSize int, poolSize int, httpClient *http.Client) (*MapDConn, error) {
+	clients := NewClientPool(url, bufferSize, poolSize, httpClient)
+	conn := &MapDConn{Clients: clients, user: user, pwd: pwd, db: db}
+	sessionID, err := conn.connect()
 	if err != nil {
+		clients.Close()
 		return nil, err
 	}
 
 	log.Println("connected to mapd server: ", sessionID)
-	conn := &MapDConn{Client: client, Session: sessionID}
-	ConnectionInfo(conn)
+	conn.Session = sessionID
 	info, err := ConnectionInfo(conn)
 	if err != nil {
+		clients.Close()
 		return nil, err
 	}
 	jInfo, err := json.Marshal(info)
@@ -56,21 +73,83 @@ func ConnectToMapD(user string, pwd string, db string, url string, bufferSize in
 		return nil, err
 	}
 	log.Println(string(jInfo))
+	conn.Version = info.Version
 
 	return conn, err
 }
 
-// ConnectToMapDWithRetry connect to mapd core server with a retry
-func ConnectToMapDWithRetry(user string, pwd string, db string, url string, bufferSize int, attempts int, sleep time.Duration) (*MapDConn, error) {
-	return retry(attempts, sleep, func() (*MapDConn, error) {
-		log.Println("connecting to mapd server...")
-		return ConnectToMapD(user, pwd, db, url, bufferSize)
+// CurrentSession the session of the connection, safe to call while the connection is being re-established
+func (c *MapDConn) CurrentSession() mapd.TSessionId {
+	c.sessionMu.RLock()
+	defer c.sessionMu.RUnlock()
+	return c.Session
+}
+
+// CurrentVersion the version of the mapd server the connection was last established with
+func (c *MapDConn) CurrentVersion() string {
+	c.sessionMu.RLock()
+	defer c.sessionMu.RUnlock()
+	return c.Version
+}
+
+// Reconnect open a new session to replace the stale one. If the session was already replaced by a concurrent
+// caller the current session is returned without reconnecting.
+func (c *MapDConn) Reconnect(stale mapd.TSessionId) (mapd.TSessionId, error) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+
+	if current := c.CurrentSession(); current != stale {
+		return current, nil
+	}
+	log.Println("reconnecting to mapd server, stale session: ", stale)
+	session, err := c.reconnect()
+	metricsutil.ObserveReconnect("shared", err)
+	return session, err
+}
+
+// reconnect open a new session and swap it in with the version of the server it was opened on
+func (c *MapDConn) reconnect() (mapd.TSessionId, error) {
+	session, err := c.connect()
+	if err != nil {
+		return "", err
+	}
+	var status *mapd.TServerStatus
+	err = c.Clients.Call(func(client *mapd.MapDClient) (err error) {
+		status, err = client.GetServerStatus(session)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	c.sessionMu.Lock()
+	c.Session = session
+	c.Version = status.Version
+	c.sessionMu.Unlock()
+	return session, nil
+}
+
+// connect open a new session with the credentials of the connection
+func (c *MapDConn) connect() (session mapd.TSessionId, err error) {
+	err = c.Clients.Call(func(client *mapd.MapDClient) (err error) {
+		session, err = client.Connect(c.user, c.pwd, c.db)
+		return err
 	})
+	return session, err
+}
+
+// IsInvalidSession whether mapd-core rejected a call because the session expired or was lost in a restart
+func IsInvalidSession(e *mapd.TMapDException) bool {
+	return e != nil && strings.Contains(strings.ToLower(e.ErrorMsg), "session not valid")
 }
 
 // ConnectionInfo get mapd connection info
 func ConnectionInfo(con *MapDConn) (*MapDConnInfo, error) {
-	serverInfo, err := con.Client.GetServerStatus(con.Session)
+	var serverInfo *mapd.TServerStatus
+	session := con.CurrentSession()
+	err := con.Clients.Call(func(client *mapd.MapDClient) (err error) {
+		serverInfo, err = client.GetServerStatus(session)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -78,16 +157,16 @@ func ConnectionInfo(con *MapDConn) (*MapDConnInfo, error) {
 	return hcr, nil
 }
 
-func retry(attempts int, sleep time.Duration, action func() (*MapDConn, error)) (*MapDConn, error) {
-	var err error
-	var con *MapDConn
-	for i := 0; i < attempts; i++ {
-		con, err = action()
-		if err == nil {
-			return con, err
-		}
-		time.Sleep(sleep)
-		log.Println("retrying action after error: ", err)
-	}
-	return con, err
-}
\ No newline at end of file
+// Close disconnect the session and close the clients
+func (c *MapDConn) Close() {
+	session := c.CurrentSession()
+	c.Clients.Call(func(client *mapd.MapDClient) error {
+		return client.Disconnect(session)
+	})
+	c.Clients.Close()
+}
+
+// ServerInfo get mapd connection info
+func (c *MapDConn) ServerInfo() (*MapDConnInfo, error) {
+	return ConnectionInfo(c)
+}
@@ -0,0 +1,214 @@
+package mapdutil
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/shusson/mapd-api/metricsutil"
+	"github.com/shusson/mapd-api/thrift/e745367/mapd"
+)
+
+// ClientSession a client that connected through the proxy with its own credentials. The proxy hands the client
+// an opaque token and opens a session as the client's user on each backend the client's requests are sent to.
+type ClientSession struct {
+	User string
+	DB   string
+
+	pwd      string
+	mu       sync.Mutex
+	backends map[*Backend]mapd.TSessionId
+	lastUsed time.Time
+}
+
+// SessionStore maps the tokens issued to clients to their sessions on the backends. Tokens only live in the memory of
+// the instance that issued them, the credentials behind them are never written elsewhere.
+type SessionStore struct {
+	mu           sync.RWMutex
+	sessions     map[mapd.TSessionId]*ClientSession
+	impersonated map[string]*ClientSession
+}
+
+// NewSessionStore construct an empty session store
+func NewSessionStore() *SessionStore {
+	return &SessionStore{sessions: make(map[mapd.TSessionId]*ClientSession), impersonated: make(map[string]*ClientSession)}
+}
+
+// Open authenticate the user against the backend and issue a proxy token for the new client session
+func (s *SessionStore) Open(b *Backend, user string, pwd string, db string) (mapd.TSessionId, error) {
+	session, err := OpenSession(b, user, pwd, db)
+	if err != nil {
+		return "", err
+	}
+	token, err := newToken()
+	if err != nil {
+		CloseSession(b, session)
+		return "", err
+	}
+	cs := &ClientSession{User: user, DB: db, pwd: pwd, backends: map[*Backend]mapd.TSessionId{b: session}, lastUsed: time.Now()}
+	s.mu.Lock()
+	s.sessions[token] = cs
+	s.mu.Unlock()
+	return token, nil
+}
+
+// Impersonate the client session of a user whose credentials the proxy holds, for calls the proxy makes on behalf
+// of that user without a token. Like any client session its backend sessions are opened on first use.
+func (s *SessionStore) Impersonate(user string, pwd string, db string) *ClientSession {
+	key := user + "\x00" + db
+	s.mu.RLock()
+	cs, ok := s.impersonated[key]
+	s.mu.RUnlock()
+	if ok {
+		return cs
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cs, ok := s.impersonated[key]; ok {
+		return cs
+	}
+	cs = &ClientSession{User: user, DB: db, pwd: pwd, backends: make(map[*Backend]mapd.TSessionId), lastUsed: time.Now()}
+	s.impersonated[key] = cs
+	return cs
+}
+
+// Lookup the client session a token was issued for
+func (s *SessionStore) Lookup(token mapd.TSessionId) (*ClientSession, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cs, ok := s.sessions[token]
+	return cs, ok
+}
+
+// BackendSession the client's session on the backend, opened on first use
+func (s *SessionStore) BackendSession(cs *ClientSession, b *Backend) (mapd.TSessionId, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.lastUsed = time.Now()
+	if session, ok := cs.backends[b]; ok {
+		return session, nil
+	}
+	session, err := OpenSession(b, cs.User, cs.pwd, cs.DB)
+	if err != nil {
+		return "", err
+	}
+	cs.backends[b] = session
+	return session, nil
+}
+
+// Reconnect replace the client's session on the backend after mapd-core rejected it
+func (s *SessionStore) Reconnect(cs *ClientSession, b *Backend, stale mapd.TSessionId) (mapd.TSessionId, error) {
+	cs.mu.Lock()
+	if current, ok := cs.backends[b]; ok && current == stale {
+		delete(cs.backends, b)
+	}
+	cs.mu.Unlock()
+	session, err := s.BackendSession(cs, b)
+	metricsutil.ObserveReconnect("client", err)
+	return session, err
+}
+
+// Close forget the token and disconnect the client's sessions on every backend
+func (s *SessionStore) Close(token mapd.TSessionId) {
+	s.mu.Lock()
+	cs, ok := s.sessions[token]
+	delete(s.sessions, token)
+	s.mu.Unlock()
+	if ok {
+		s.disconnect(cs)
+	}
+}
+
+// CloseAll forget every token and disconnect every client session
+func (s *SessionStore) CloseAll() {
+	s.mu.Lock()
+	sessions := s.sessions
+	s.sessions = make(map[mapd.TSessionId]*ClientSession)
+	impersonated := s.impersonated
+	s.impersonated = make(map[string]*ClientSession)
+	s.mu.Unlock()
+	for _, cs := range sessions {
+		s.disconnect(cs)
+	}
+	for _, cs := range impersonated {
+		s.disconnect(cs)
+	}
+}
+
+// Expire close the client sessions that have not been used for longer than maxIdle. Impersonated users keep their
+// client session, its backend sessions are opened again when next used.
+func (s *SessionStore) Expire(maxIdle time.Duration) {
+	var idle []*ClientSession
+	s.mu.Lock()
+	for token, cs := range s.sessions {
+		cs.mu.Lock()
+		if time.Since(cs.lastUsed) > maxIdle {
+			idle = append(idle, cs)
+			delete(s.sessions, token)
+		}
+		cs.mu.Unlock()
+	}
+	impersonated := make([]*ClientSession, 0, len(s.impersonated))
+	for _, cs := range s.impersonated {
+		impersonated = append(impersonated, cs)
+	}
+	s.mu.Unlock()
+	for _, cs := range idle {
+		s.disconnect(cs)
+	}
+	for _, cs := range impersonated {
+		cs.mu.Lock()
+		expired := time.Since(cs.lastUsed) > maxIdle && len(cs.backends) > 0
+		cs.mu.Unlock()
+		if expired {
+			s.disconnect(cs)
+		}
+	}
+	if len(idle) > 0 {
+		log.Printf("expired %d idle client sessions\n", len(idle))
+	}
+}
+
+func (s *SessionStore) disconnect(cs *ClientSession) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for b, session := range cs.backends {
+		CloseSession(b, session)
+	}
+	cs.backends = make(map[*Backend]mapd.TSessionId)
+}
+
+// OpenSession connect to the backend as the user with one of the backend's pooled clients
+func OpenSession(b *Backend, user string, pwd string, db string) (session mapd.TSessionId, err error) {
+	conn := b.Conn()
+	if conn == nil {
+		return "", ErrNoHealthyBackend
+	}
+	err = conn.Clients.Call(func(client *mapd.MapDClient) (err error) {
+		session, err = client.Connect(user, pwd, db)
+		return err
+	})
+	return session, err
+}
+
+// CloseSession disconnect a session opened with OpenSession
+func CloseSession(b *Backend, session mapd.TSessionId) error {
+	conn := b.Conn()
+	if conn == nil {
+		return ErrNoHealthyBackend
+	}
+	return conn.Clients.Call(func(client *mapd.MapDClient) error {
+		return client.Disconnect(session)
+	})
+}
+
+// newToken a random token in the same format as a mapd session id
+func newToken() (mapd.TSessionId, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return mapd.TSessionId(hex.EncodeToString(b)), nil
+}
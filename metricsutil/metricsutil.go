@@ -0,0 +1,143 @@
+package metricsutil
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "mapd_api"
+
+// latencyBuckets seconds, from a cached dashboard widget to a full table scan
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+var (
+	// Requests thrift requests served by the proxy by method and http status
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Thrift requests served by the proxy by method and http status.",
+	}, []string{"method", "status"})
+
+	// CacheHits responses served from redis
+	CacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_hits_total",
+		Help:      "Responses served from the redis cache.",
+	})
+
+	// CacheMisses cache lookups that found no usable response
+	CacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_misses_total",
+		Help:      "Cache lookups that found no usable response.",
+	})
+
+	// CacheSets responses written to redis
+	CacheSets = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_sets_total",
+		Help:      "Responses written to the redis cache.",
+	})
+
+	// RedisErrors failed redis commands by operation
+	RedisErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redis_errors_total",
+		Help:      "Failed redis commands by operation.",
+	}, []string{"op"})
+
+	// UpstreamLatency time for mapd-core to answer a proxied request by method
+	UpstreamLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_latency_seconds",
+		Help:      "Time for mapd-core to answer a proxied request by method.",
+		Buckets:   latencyBuckets,
+	}, []string{"method"})
+
+	// ExecutionTime the execution_time_ms mapd-core reported for a query
+	ExecutionTime = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "mapd_execution_seconds",
+		Help:      "Query execution time reported by mapd-core.",
+		Buckets:   latencyBuckets,
+	})
+
+	// TotalTime the total_time_ms mapd-core reported for a query
+	TotalTime = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "mapd_total_seconds",
+		Help:      "Total query time, including result serialization, reported by mapd-core.",
+		Buckets:   latencyBuckets,
+	})
+
+	// Reconnects sessions re-established after mapd-core rejected them by session mode and result
+	Reconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "session_reconnects_total",
+		Help:      "Sessions re-established after mapd-core rejected them by session mode and result.",
+	}, []string{"mode", "result"})
+
+	// Rejections calls refused before they reached mapd-core by reason
+	Rejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rejections_total",
+		Help:      "Calls refused before they reached mapd-core by reason.",
+	}, []string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(Requests, CacheHits, CacheMisses, CacheSets, RedisErrors, UpstreamLatency, ExecutionTime, TotalTime, Reconnects, Rejections)
+}
+
+// Handler serves the metrics in the prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveRequest count a served request
+func ObserveRequest(method string, status int) {
+	Requests.WithLabelValues(method, strconv.Itoa(status)).Inc()
+}
+
+// ObserveQueryTimes record the times mapd-core reported for a query
+func ObserveQueryTimes(executionMs int64, totalMs int64) {
+	ExecutionTime.Observe(float64(executionMs) / 1000)
+	TotalTime.Observe(float64(totalMs) / 1000)
+}
+
+// ObserveReconnect count a reconnect attempt
+func ObserveReconnect(mode string, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	Reconnects.WithLabelValues(mode, result).Inc()
+}
+
+// StatusRecorder remembers the status and the number of bytes written through a ResponseWriter
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int
+	Bytes  int
+}
+
+// NewStatusRecorder wrap a ResponseWriter, the status defaults to 200 as with net/http
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+// WriteHeader record the status and pass it on
+func (r *StatusRecorder) WriteHeader(status int) {
+	r.Status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write count the bytes and pass them on
+func (r *StatusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.Bytes += n
+	return n, err
+}
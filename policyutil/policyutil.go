@@ -0,0 +1,172 @@
+package policyutil
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/shusson/mapd-api/sqlutil"
+	"github.com/shusson/mapd-api/thriftutil"
+)
+
+// readStatements the statement types allowed in read only mode
+var readStatements = map[string]bool{
+	"SELECT": true, "WITH": true, "EXPLAIN": true, "SHOW": true,
+}
+
+// writeMethods the methods that change data, dashboards or the state of the server, denied in read only mode
+var writeMethods = map[string]bool{
+	"load_table": true, "load_table_binary": true, "import_table": true, "import_geo_table": true,
+	"insert_data": true, "create_table": true, "create_frontend_view": true, "delete_frontend_view": true,
+	"create_link": true, "clear_cpu_memory": true, "clear_gpu_memory": true, "set_execution_mode": true,
+	"start_heap_profile": true, "stop_heap_profile": true, "interrupt": true, "start_query": true,
+	"execute_first_step": true, "broadcast_serialized_rows": true,
+}
+
+// fingerprintID a fingerprint id as reported in the access log
+var fingerprintID = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// Rejection a call the policy does not permit, the message is passed on to the client
+type Rejection struct {
+	Message string
+}
+
+func (r *Rejection) Error() string {
+	return r.Message
+}
+
+func reject(format string, a ...interface{}) error {
+	return &Rejection{Message: fmt.Sprintf(format, a...)}
+}
+
+// Policy which calls the proxy forwards to mapd-core. The zero Policy permits everything.
+type Policy struct {
+	// ReadOnly deny every method and statement that writes
+	ReadOnly bool
+	// AllowMethods if not empty only these methods are permitted
+	AllowMethods map[string]bool
+	// DenyMethods methods that are never permitted
+	DenyMethods map[string]bool
+	// AllowStatements if not empty only these statement types are permitted, upper cased
+	AllowStatements map[string]bool
+	// DenyStatements statement types that are never permitted, upper cased
+	DenyStatements map[string]bool
+	// QueryPatterns and Fingerprints if either is set every query must have one of the fingerprints or each of its
+	// statements must match a pattern or have one of the fingerprints, e.g. to only permit the queries of a public
+	// dashboard. Patterns are matched against a statement with its whitespace collapsed by sqlutil.NormalizeQuery.
+	QueryPatterns []*regexp.Regexp
+	Fingerprints  map[string]bool
+}
+
+// AllowFingerprint permit the queries with a fingerprint, given either as its id or as a query
+func (p *Policy) AllowFingerprint(fingerprint string) {
+	if p.Fingerprints == nil {
+		p.Fingerprints = make(map[string]bool)
+	}
+	if fingerprintID.MatchString(fingerprint) {
+		p.Fingerprints[fingerprint] = true
+		return
+	}
+	p.Fingerprints[sqlutil.FingerprintID(sqlutil.Fingerprint(fingerprint))] = true
+}
+
+// Restricts whether the policy restricts any call, calls that can not be checked are then rejected
+func (p *Policy) Restricts() bool {
+	return p != nil && (p.ReadOnly || len(p.AllowMethods) > 0 || len(p.DenyMethods) > 0 || len(p.AllowStatements) > 0 ||
+		len(p.DenyStatements) > 0 || len(p.QueryPatterns) > 0 || len(p.Fingerprints) > 0)
+}
+
+// Check whether the policy permits the call, a *Rejection if it does not
+func (p *Policy) Check(req *thriftutil.Request) error {
+	if p == nil {
+		return nil
+	}
+	if len(p.AllowMethods) > 0 && !p.AllowMethods[req.Method] || p.DenyMethods[req.Method] {
+		return reject("%s is not permitted through the mapd-api proxy", req.Method)
+	}
+	if p.ReadOnly && writeMethods[req.Method] {
+		return reject("%s is not permitted, the mapd-api proxy is read only", req.Method)
+	}
+	var queries []string
+	if query := req.Query(); query != "" {
+		queries = append(queries, query)
+	}
+	// the sql of a render call is checked like any other query
+	vegaQueries, err := req.VegaQueries()
+	if err != nil && p.checksQueries() {
+		return reject("%s", err.Error())
+	}
+	for _, query := range append(queries, vegaQueries...) {
+		if err := p.checkQuery(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checksQueries whether the policy restricts the sql of a call
+func (p *Policy) checksQueries() bool {
+	return p.ReadOnly || len(p.AllowStatements) > 0 || len(p.DenyStatements) > 0 || len(p.QueryPatterns) > 0 || len(p.Fingerprints) > 0
+}
+
+func (p *Policy) checkQuery(query string) error {
+	statements := sqlutil.Statements(query)
+	for _, statement := range statements {
+		if err := p.checkStatement(statement); err != nil {
+			return err
+		}
+	}
+	if len(p.QueryPatterns) == 0 && len(p.Fingerprints) == 0 || p.hasFingerprint(query) {
+		return nil
+	}
+	// a pattern is matched against one statement at a time so that statements can not be appended to a query it
+	// permits
+	for _, statement := range statements {
+		if !p.hasFingerprint(statement) && !p.matches(statement) {
+			return reject("query is not permitted through the mapd-api proxy")
+		}
+	}
+	if len(statements) == 0 {
+		return reject("query is not permitted through the mapd-api proxy")
+	}
+	return nil
+}
+
+// checkStatement check the type of a statement, a statement with a WITH clause both as WITH and as the statement
+// the clause belongs to, e.g. INSERT
+func (p *Policy) checkStatement(statement string) error {
+	types := []string{sqlutil.StatementType(statement)}
+	if qt := sqlutil.QueryType(statement); qt != types[0] {
+		types = append(types, qt)
+	}
+	for _, st := range types {
+		if len(p.AllowStatements) > 0 && !p.AllowStatements[st] || p.DenyStatements[st] {
+			return reject("%s statements are not permitted through the mapd-api proxy", describe(st))
+		}
+	}
+	if st := types[len(types)-1]; p.ReadOnly && !readStatements[st] {
+		return reject("%s statements are not permitted, the mapd-api proxy is read only", describe(st))
+	}
+	return nil
+}
+
+func (p *Policy) hasFingerprint(sql string) bool {
+	return p.Fingerprints[sqlutil.FingerprintID(sqlutil.Fingerprint(sql))]
+}
+
+// matches whether a statement matches one of the patterns
+func (p *Policy) matches(statement string) bool {
+	normalized := sqlutil.NormalizeQuery(statement)
+	for _, re := range p.QueryPatterns {
+		if re.MatchString(normalized) {
+			return true
+		}
+	}
+	return false
+}
+
+func describe(statementType string) string {
+	if statementType == "" {
+		return "unrecognised"
+	}
+	return statementType
+}
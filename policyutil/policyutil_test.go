@@ -0,0 +1,46 @@
+package policyutil
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/shusson/mapd-api/thrift/e745367/mapd"
+	"github.com/shusson/mapd-api/thriftutil"
+)
+
+func TestCheckAllowlist(t *testing.T) {
+	p := &Policy{QueryPatterns: []*regexp.Regexp{
+		regexp.MustCompile(`^SELECT COUNT\(\*\) FROM flights`),
+		regexp.MustCompile(`^SELECT a{1,3} FROM t$`),
+	}}
+	p.AllowFingerprint("SELECT x FROM airports WHERE code = 'SYD'")
+	p.AllowFingerprint("SELECT 1; SELECT 2")
+	tests := []struct {
+		query   string
+		allowed bool
+	}{
+		{"SELECT COUNT(*) FROM flights", true},
+		{"SELECT COUNT(*)   FROM flights WHERE year = 2008;", true},
+		{"SELECT COUNT(*) FROM flights; DROP TABLE flights", false},
+		{"SELECT COUNT(*) FROM flights; SELECT * FROM secret", false},
+		{"SELECT COUNT(*) FROM flights; SELECT COUNT(*) FROM flights", true},
+		{"SELECT aaa FROM t", true},
+		{"SELECT aaa FROM t; SELECT aaa FROM t", true},
+		{"SELECT aaaa FROM t", false},
+		{"SELECT x FROM airports WHERE code = 'LAX'", true},
+		{"SELECT x FROM airports WHERE code = 'LAX'; DELETE FROM airports", false},
+		{"SELECT 1; SELECT 2", true},
+		{"SELECT * FROM secret", false},
+		{"-- SELECT COUNT(*) FROM flights", false},
+	}
+	for _, test := range tests {
+		req := &thriftutil.Request{Method: "sql_execute", Args: &mapd.MapDSqlExecuteArgs{Query: test.query}}
+		err := p.Check(req)
+		if test.allowed && err != nil {
+			t.Errorf("Check(%q): unexpected error %v", test.query, err)
+		}
+		if !test.allowed && err == nil {
+			t.Errorf("Check(%q) permitted, want a rejection", test.query)
+		}
+	}
+}
@@ -3,7 +3,13 @@ package proxyutil
 import (
 	"github.com/garyburd/redigo/redis"
 	"io/ioutil"
-	"github.com/shusson/mapd-api/redisutil"
+	"github.com/shusson/mapd-api/cacheutil"
+	"github.com/shusson/mapd-api/thriftutil"
+	"github.com/shusson/mapd-api/mapdutil"
+	"github.com/shusson/mapd-api/metricsutil"
+	"github.com/shusson/mapd-api/thrift/e745367/mapd"
+	"log"
+	"time"
 	"bytes"
 	"net/http"
 	"net/url"
@@ -15,31 +21,133 @@ type Transport struct {
 	http.RoundTripper
 	Key string
 	Pool *redis.Pool
+	TTL time.Duration
+	Tables []string
+	// Request the decoded call being proxied, required to retry it with a new session
+	Request *thriftutil.Request
+	// Reconnect replaces a session that mapd-core no longer accepts, if nil the call is not retried
+	Reconnect func(stale mapd.TSessionId) (mapd.TSessionId, error)
+
+	// Status the http status of the last mapd-core response, 0 if mapd-core could not be reached
+	Status int
+	// Upstream time spent waiting on mapd-core, including a retry
+	Upstream time.Duration
+	// ExecutionTimeMs and TotalTimeMs as reported by mapd-core with a query result
+	ExecutionTimeMs int64
+	TotalTimeMs int64
 }
 
-// RoundTrip intercept the response from mapd and cache the value in redis
+// RoundTrip intercept the response from mapd, retry calls rejected for an invalid session once with a new
+// session and cache the value in redis
 func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	resp, err = t.RoundTripper.RoundTrip(req)
+	resp, b, err := t.roundTrip(req)
 	if err != nil {
 		return nil, err
 	}
+	reply := t.decodeReply(resp, b)
+
+	if t.Reconnect != nil && invalidSession(reply) {
+		retry, err := t.withNewSession(req)
+		if err != nil {
+			log.Println("failed to re-establish mapd session: " + err.Error())
+		} else {
+			resp, b, err = t.roundTrip(retry)
+			if err != nil {
+				return nil, err
+			}
+			reply = t.decodeReply(resp, b)
+		}
+	}
+
+	t.observeQueryTimes(reply)
+
+	if t.Key != "" && cacheable(reply) {
+		if err := cacheutil.Store(t.Pool, t.Key, b, t.TTL, t.Tables); err != nil {
+			log.Println("failed to cache response: " + err.Error())
+		}
+	}
+
+	body := ioutil.NopCloser(bytes.NewReader(b))
+	resp.Body = body
+	resp.ContentLength = int64(len(b))
+	return resp, nil
+}
+
+func (t *Transport) roundTrip(req *http.Request) (*http.Response, []byte, error) {
+	method := "unknown"
+	if t.Request != nil {
+		method = t.Request.Method
+	}
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, nil, err
+	}
 	b, err := ioutil.ReadAll(resp.Body)
+	elapsed := time.Since(start)
+	t.Upstream += elapsed
+	t.Status = resp.StatusCode
+	metricsutil.UpstreamLatency.WithLabelValues(method).Observe(elapsed.Seconds())
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	err = resp.Body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, b, nil
+}
+
+// withNewSession reconnect and build a copy of the request that carries the new session
+func (t *Transport) withNewSession(req *http.Request) (*http.Request, error) {
+	session, err := t.Reconnect(t.Request.Session())
 	if err != nil {
 		return nil, err
 	}
+	t.Request.SetSession(session)
+	body, err := t.Request.Encode()
+	if err != nil {
+		return nil, err
+	}
+	retry := req.WithContext(req.Context())
+	retry.ContentLength = int64(len(body))
+	retry.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return retry, nil
+}
 
-	if t.Key != "" {
-		redisutil.Set(t.Pool, t.Key, b)
+// decodeReply the reply of mapd-core to a decoded call, decoded once for every use of it. nil if the call was not
+// decoded, mapd-core did not answer with a 200 or the reply can not be read.
+func (t *Transport) decodeReply(resp *http.Response, body []byte) *thriftutil.Response {
+	if t.Request == nil || resp.StatusCode != http.StatusOK {
+		return nil
 	}
+	reply, err := thriftutil.DecodeResponse(body)
+	if err != nil {
+		return nil
+	}
+	return reply
+}
 
-	body := ioutil.NopCloser(bytes.NewReader(b))
-	resp.Body = body
-	resp.ContentLength = int64(len(b))
-	return resp, nil
+// invalidSession whether mapd-core rejected the call because it did not recognise the session
+func invalidSession(reply *thriftutil.Response) bool {
+	return reply != nil && mapdutil.IsInvalidSession(reply.Exception())
+}
+
+// cacheable only successful replies are cached, errors such as a transient out of memory on the gpu are passed through
+func cacheable(reply *thriftutil.Response) bool {
+	return reply != nil && reply.Succeeded()
+}
+
+// observeQueryTimes record the execution and total time mapd-core reports with a query result
+func (t *Transport) observeQueryTimes(reply *thriftutil.Response) {
+	if reply == nil {
+		return
+	}
+	if result, ok := reply.Result.(*mapd.MapDSqlExecuteResult); ok && result.Success != nil {
+		t.ExecutionTimeMs = result.Success.ExecutionTimeMs
+		t.TotalTimeMs = result.Success.TotalTimeMs
+		metricsutil.ObserveQueryTimes(t.ExecutionTimeMs, t.TotalTimeMs)
+	}
 }
 
 // ReverseProxy reverse proxies to a server
@@ -55,3 +163,10 @@ func ReverseProxy(w http.ResponseWriter, r *http.Request, body []byte, serverURL
 	}
 	handler.ServeHTTP(w, r)
 }
+
+// WriteThrift write a thrift response that did not come from the reverse proxy
+func WriteThrift(w http.ResponseWriter, body []byte) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/x-thrift")
+	w.Write(body)
+}
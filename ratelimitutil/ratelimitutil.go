@@ -0,0 +1,254 @@
+package ratelimitutil
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/shusson/mapd-api/metricsutil"
+)
+
+const (
+	// pruneInterval how often buckets that have refilled are dropped
+	pruneInterval = time.Minute
+	// bucketPrefix of the redis hash of a client's token bucket
+	bucketPrefix = "mapd-api:ratelimit:"
+	// concurrencyPrefix of the redis sorted set of a client's running calls, scored by when their lease expires
+	concurrencyPrefix = "mapd-api:concurrency:"
+)
+
+// bucketScript take a token from a bucket, returns 1 if there was one and 0 otherwise. An unused bucket expires once
+// it would have refilled.
+// KEYS[1] bucket, ARGV[1] rate per second, ARGV[2] burst, ARGV[3] now in milliseconds
+var bucketScript = redis.NewScript(1, `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+if now > ts then
+	tokens = math.min(burst, tokens + (now - ts) / 1000 * rate)
+	ts = now
+end
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(ts))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return allowed
+`)
+
+// acquireScript add a call to the running calls if there are fewer than the maximum, returns 1 if it was added and 0
+// otherwise. Calls whose lease has expired, e.g. those of an instance that died, are dropped first.
+// KEYS[1] running calls, ARGV[1] maximum, ARGV[2] now in milliseconds, ARGV[3] lease in milliseconds, ARGV[4] call id
+var acquireScript = redis.NewScript(1, `
+local now = tonumber(ARGV[2])
+local lease = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], now + lease, ARGV[4])
+redis.call('PEXPIRE', KEYS[1], lease)
+return 1
+`)
+
+// Limits how many calls a client may make
+type Limits struct {
+	// Rate calls per second, 0 is unlimited. Burst calls may be made at once, see Burst.
+	Rate  float64
+	Burst int
+	// MaxConcurrent calls that may be running at once, 0 is unlimited
+	MaxConcurrent int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  float64
+}
+
+// refill add the tokens earned since the bucket was last used
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// Limiter token buckets and concurrency caps by client name, safe for concurrent use. With a redis pool they are
+// shared by every instance using the same redis, falling back to the instance's own when redis fails.
+type Limiter struct {
+	pool  *redis.Pool
+	lease time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	running map[string]int
+	pruned  time.Time
+	calls   uint64
+	// local whether limits are kept locally because redis failed
+	local bool
+}
+
+// NewLimiter a limiter that coordinates through redis if pool is not nil. lease is how long a call counts against
+// the concurrency cap in redis if it is never released.
+func NewLimiter(pool *redis.Pool, lease time.Duration) *Limiter {
+	return &Limiter{pool: pool, lease: lease, buckets: make(map[string]*bucket), running: make(map[string]int), pruned: time.Now()}
+}
+
+// Burst the size of a bucket, burst or if it is not positive the rate rounded up
+func Burst(rate float64, burst int) int {
+	if burst > 0 {
+		return burst
+	}
+	return int(math.Max(1, math.Ceil(rate)))
+}
+
+// Allow take a token from the bucket of name, which holds up to burst tokens and refills at rate tokens per
+// second. False if the bucket is empty. A rate that is not positive is unlimited.
+func (l *Limiter) Allow(name string, rate float64, burst int) bool {
+	if rate <= 0 {
+		return true
+	}
+	if l.pool != nil {
+		allowed, err := l.allowShared(name, rate, Burst(rate, burst))
+		l.redisResult("ratelimit", err)
+		if err == nil {
+			return allowed
+		}
+	}
+	return l.allowLocal(name, rate, burst)
+}
+
+func (l *Limiter) allowShared(name string, rate float64, burst int) (bool, error) {
+	conn := l.pool.Get()
+	defer conn.Close()
+	return redis.Bool(bucketScript.Do(conn, bucketPrefix+name, rate, burst, milliseconds(time.Now())))
+}
+
+func (l *Limiter) allowLocal(name string, rate float64, burst int) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.pruned) > pruneInterval {
+		l.prune(now)
+	}
+	b, ok := l.buckets[name]
+	if !ok {
+		b = &bucket{last: now}
+		l.buckets[name] = b
+	}
+	// a changed limit applies from now on, without resetting the tokens already earned
+	b.rate, b.burst = rate, float64(Burst(rate, burst))
+	if !ok {
+		b.tokens = b.burst
+	}
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune drop the buckets that are full, they are created full again when next used
+func (l *Limiter) prune(now time.Time) {
+	for name, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= b.burst {
+			delete(l.buckets, name)
+		}
+	}
+	l.pruned = now
+}
+
+// Acquire count a call against the concurrency cap of name, false if max calls are already running. release must
+// be called once the call is done. A max that is not positive is unlimited.
+func (l *Limiter) Acquire(name string, max int) (release func(), ok bool) {
+	if max <= 0 {
+		return func() {}, true
+	}
+	if l.pool != nil {
+		release, ok, err := l.acquireShared(name, max)
+		l.redisResult("concurrency", err)
+		if err == nil {
+			return release, ok
+		}
+	}
+	return l.acquireLocal(name, max)
+}
+
+func (l *Limiter) acquireShared(name string, max int) (func(), bool, error) {
+	l.mu.Lock()
+	l.calls++
+	id := strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatUint(l.calls, 36)
+	l.mu.Unlock()
+
+	key := concurrencyPrefix + name
+	conn := l.pool.Get()
+	defer conn.Close()
+	ok, err := redis.Bool(acquireScript.Do(conn, key, max, milliseconds(time.Now()), int64(l.lease/time.Millisecond), id))
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	release := func() {
+		conn := l.pool.Get()
+		defer conn.Close()
+		if _, err := conn.Do("ZREM", key, id); err != nil {
+			metricsutil.RedisErrors.WithLabelValues("concurrency").Inc()
+		}
+	}
+	return release, true, nil
+}
+
+func (l *Limiter) acquireLocal(name string, max int) (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.running[name] >= max {
+		return nil, false
+	}
+	l.running[name]++
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.running[name]--; l.running[name] <= 0 {
+				delete(l.running, name)
+			}
+		})
+	}
+	return release, true
+}
+
+// redisResult count a failed redis call and log when the limiter falls back to local limits and when it returns
+// to redis
+func (l *Limiter) redisResult(op string, err error) {
+	if err != nil {
+		metricsutil.RedisErrors.WithLabelValues(op).Inc()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case err != nil && !l.local:
+		log.Println("failed to reach redis, limiting calls locally: " + err.Error())
+	case err == nil && l.local:
+		log.Println("redis reachable again, limiting calls across instances")
+	}
+	l.local = err != nil
+}
+
+func milliseconds(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
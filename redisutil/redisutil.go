@@ -2,6 +2,7 @@ package redisutil
 
 import (
 	"github.com/garyburd/redigo/redis"
+	"github.com/shusson/mapd-api/metricsutil"
 	"time"
 )
 
@@ -25,14 +26,9 @@ func Get(pool *redis.Pool, key string) ([]byte, error) {
 	conn := pool.Get()
 	defer conn.Close()
 
-	return redis.Bytes(conn.Do("GET", key))
+	value, err := redis.Bytes(conn.Do("GET", key))
+	if err != nil && err != redis.ErrNil {
+		metricsutil.RedisErrors.WithLabelValues("get").Inc()
+	}
+	return value, err
 }
-
-// Set redis set
-func Set(pool *redis.Pool, key string, value []byte) error {
-	conn := pool.Get()
-	defer conn.Close()
-
-	_, err := conn.Do("SET", key, value)
-	return err
-}
\ No newline at end of file
@@ -0,0 +1,86 @@
+package sqlutil
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Fingerprint the shape of a statement with every literal replaced by ?, so that queries which only differ in
+// their constants, formatting or comments group together. Lists of literals collapse to a single ?, e.g.
+// IN (1, 2, 3) becomes in (?).
+func Fingerprint(query string) string {
+	var parts []string
+	for _, t := range Tokenize(query) {
+		switch {
+		case t.Kind == String || t.Kind == Number:
+			// a sign in front of a number is part of the literal
+			if n := len(parts); n > 0 && (parts[n-1] == "-" || parts[n-1] == "+") && unarySign(parts[:n-1]) {
+				parts = parts[:n-1]
+			}
+			// ?, ? collapses to ?
+			if n := len(parts); n > 1 && parts[n-1] == "," && parts[n-2] == "?" {
+				parts = parts[:n-1]
+				continue
+			}
+			parts = append(parts, "?")
+		case t.Kind == Word:
+			parts = append(parts, t.Ident())
+		default:
+			parts = append(parts, t.Text)
+		}
+	}
+
+	for len(parts) > 0 && parts[len(parts)-1] == ";" {
+		parts = parts[:len(parts)-1]
+	}
+
+	var b bytes.Buffer
+	for i, p := range parts {
+		call := p == "(" && i > 0 && isName(parts[i-1])
+		if i > 0 && !call && p != "," && p != ")" && p != "." && parts[i-1] != "(" && parts[i-1] != "." {
+			b.WriteByte(' ')
+		}
+		b.WriteString(p)
+	}
+	return b.String()
+}
+
+// FingerprintID a short stable id of a fingerprint for use in logs and metrics
+func FingerprintID(fingerprint string) string {
+	sum := sha256.Sum256([]byte(fingerprint))
+	return hex.EncodeToString(sum[:8])
+}
+
+// unarySign whether a sign following these parts is a unary sign rather than an operator
+func unarySign(parts []string) bool {
+	if len(parts) == 0 {
+		return true
+	}
+	last := parts[len(parts)-1]
+	switch last {
+	case ")", "?":
+		return false
+	case "(", ",", "=", "<", ">", "<=", ">=", "<>", "!=", "+", "-", "*", "/", "%":
+		return true
+	}
+	return keyword(last)
+}
+
+// operatorKeywords keywords that can be followed by an expression
+var operatorKeywords = map[string]bool{
+	"and": true, "or": true, "not": true, "in": true, "between": true, "like": true, "is": true, "case": true,
+	"when": true, "then": true, "else": true, "as": true, "exists": true, "any": true, "all": true,
+}
+
+func keyword(part string) bool {
+	return clauseKeywords[part] || operatorKeywords[part]
+}
+
+// isName whether a fingerprint part names a function or column rather than being a keyword or symbol
+func isName(part string) bool {
+	if keyword(part) || part == "" {
+		return false
+	}
+	return isWordStart(rune(part[0])) || part[0] == '"'
+}
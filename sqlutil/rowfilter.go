@@ -0,0 +1,105 @@
+package sqlutil
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// AddRowFilters restrict a query to the rows of each filtered table its predicate selects. filters maps table names
+// to predicates; every reference to a filtered table, in subqueries and joins alike, is replaced with a subquery of
+// the table filtered by the predicate under the alias the reference had, or the table name if it had none. An
+// explicit TABLE t query becomes a SELECT from that subquery. Only queries, SELECT or TABLE with or without a WITH
+// clause, can be filtered. An error is returned for any other statement that references a filtered table and for a
+// name of a filtered table that is not plainly a table reference, such as a WITH query or alias named after it, so
+// that no query can read around a filter.
+func AddRowFilters(query string, filters map[string]string) (string, error) {
+	if len(filters) == 0 {
+		return query, nil
+	}
+	lower := make(map[string]string, len(filters))
+	for table, predicate := range filters {
+		lower[strings.ToLower(table)] = predicate
+	}
+	statements := Statements(query)
+	for i, statement := range statements {
+		filtered, err := filterStatement(statement, lower)
+		if err != nil {
+			return "", err
+		}
+		statements[i] = filtered
+	}
+	if len(statements) == 1 {
+		return statements[0], nil
+	}
+	return strings.Join(statements, ";\n"), nil
+}
+
+func filterStatement(statement string, filters map[string]string) (string, error) {
+	tokens := Tokenize(statement)
+	refs := TableRefs(tokens)
+
+	// the tokens that name a table or the alias of a table reference
+	names := make(map[int]bool)
+	for _, ref := range refs {
+		names[ref.End] = true
+		if ref.Alias != "" {
+			i := ref.End + 1
+			if tokens[i].Is("as") {
+				i++
+			}
+			names[i] = true
+		}
+	}
+	st := QueryType(statement)
+	for i, t := range tokens {
+		if t.Kind != Word && t.Kind != QuotedIdent {
+			continue
+		}
+		table := strings.ToLower(t.Ident())
+		if _, ok := filters[table]; !ok {
+			continue
+		}
+		if st != "SELECT" && st != "TABLE" {
+			return "", fmt.Errorf("%s statements on %s are not permitted, its rows are filtered", describe(st), table)
+		}
+		// a qualified name such as table.column
+		if i+1 < len(tokens) && tokens[i+1].Text == "." {
+			continue
+		}
+		if !names[i] {
+			return "", fmt.Errorf("%s can only be referenced as a table, its rows are filtered", table)
+		}
+	}
+
+	var b bytes.Buffer
+	last := 0
+	for _, ref := range refs {
+		predicate, ok := filters[strings.ToLower(ref.Name)]
+		if !ok {
+			continue
+		}
+		start, end := tokens[ref.Start].Pos, tokens[ref.End].End
+		if ref.Explicit {
+			// TABLE t becomes SELECT * FROM (...) AS t
+			b.WriteString(statement[last:tokens[ref.Start-1].Pos])
+			b.WriteString("SELECT * FROM ")
+		} else {
+			b.WriteString(statement[last:start])
+		}
+		fmt.Fprintf(&b, "(SELECT * FROM %s WHERE (%s))", statement[start:end], predicate)
+		if ref.Alias == "" {
+			b.WriteString(" AS " + tokens[ref.End].Text)
+		}
+		last = end
+	}
+	b.WriteString(statement[last:])
+	return b.String(), nil
+}
+
+func describe(statementType string) string {
+	if statementType == "" {
+		return "unrecognised"
+	}
+	return statementType
+}
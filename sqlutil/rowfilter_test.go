@@ -0,0 +1,72 @@
+package sqlutil
+
+import "testing"
+
+func TestAddRowFilters(t *testing.T) {
+	filters := map[string]string{"secret": "owner = 1"}
+	tests := []struct {
+		query    string
+		filtered string
+		ok       bool
+	}{
+		{"SELECT * FROM pub", "SELECT * FROM pub", true},
+		{"SELECT * FROM secret s", "SELECT * FROM (SELECT * FROM secret WHERE (owner = 1)) s", true},
+		{"SELECT * FROM Secret", "SELECT * FROM (SELECT * FROM Secret WHERE (owner = 1)) AS Secret", true},
+		{
+			"SELECT * FROM pub WHERE x IN (SELECT x FROM secret)",
+			"SELECT * FROM pub WHERE x IN (SELECT x FROM (SELECT * FROM secret WHERE (owner = 1)) AS secret)",
+			true,
+		},
+		{"TABLE secret", "SELECT * FROM (SELECT * FROM secret WHERE (owner = 1)) AS secret", true},
+		{
+			"SELECT * FROM (TABLE secret)",
+			"SELECT * FROM (SELECT * FROM (SELECT * FROM secret WHERE (owner = 1)) AS secret)",
+			true,
+		},
+		{
+			"SELECT * FROM pub WHERE x IN (TABLE secret)",
+			"SELECT * FROM pub WHERE x IN (SELECT * FROM (SELECT * FROM secret WHERE (owner = 1)) AS secret)",
+			true,
+		},
+		{
+			"SELECT * FROM pub WHERE EXISTS (TABLE secret)",
+			"SELECT * FROM pub WHERE EXISTS (SELECT * FROM (SELECT * FROM secret WHERE (owner = 1)) AS secret)",
+			true,
+		},
+		{
+			"TABLE pub UNION TABLE secret",
+			"TABLE pub UNION SELECT * FROM (SELECT * FROM secret WHERE (owner = 1)) AS secret",
+			true,
+		},
+		{
+			"WITH s AS (TABLE secret) SELECT * FROM s",
+			"WITH s AS (SELECT * FROM (SELECT * FROM secret WHERE (owner = 1)) AS secret) SELECT * FROM s",
+			true,
+		},
+		{
+			`SELECT * FROM U&"secre\0074"`,
+			`SELECT * FROM (SELECT * FROM U&"secre\0074" WHERE (owner = 1)) AS U&"secre\0074"`,
+			true,
+		},
+		{
+			`SELECT * FROM pub WHERE x IN (TABLE u&"secre!0074" UESCAPE '!')`,
+			`SELECT * FROM pub WHERE x IN (SELECT * FROM (SELECT * FROM u&"secre!0074" UESCAPE '!' WHERE (owner = 1)) AS u&"secre!0074" UESCAPE '!')`,
+			true,
+		},
+		{"SELECT * FROM TABLE(unnest(secret))", "", false},
+		{`SELECT U&"secre\0074" FROM pub`, "", false},
+		{`SELECT * FROM (SELECT 1) AS U&"\0073ecret"`, "", false},
+		{"WITH secret AS (SELECT 1) TABLE secret", "", false},
+		{"WITH s AS (SELECT 1) INSERT INTO secret SELECT * FROM s", "", false},
+		{"DELETE FROM secret", "", false},
+	}
+	for _, test := range tests {
+		filtered, err := AddRowFilters(test.query, filters)
+		if test.ok && (err != nil || filtered != test.filtered) {
+			t.Errorf("AddRowFilters(%q) = %q, %v, want %q", test.query, filtered, err, test.filtered)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("AddRowFilters(%q) = %q, want an error", test.query, filtered)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package sqlutil
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+)
+
+// NormalizeQuery collapse whitespace outside of quoted literals and strip the trailing semicolon so that
+// formatting differences do not change the identity of a query
+func NormalizeQuery(query string) string {
+	var b bytes.Buffer
+	space := false
+	var quote rune
+	for _, c := range strings.TrimSpace(query) {
+		if quote != 0 {
+			b.WriteRune(c)
+			if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		if unicode.IsSpace(c) {
+			space = true
+			continue
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		if c == '\'' || c == '"' {
+			quote = c
+		}
+		b.WriteRune(c)
+	}
+	return strings.TrimRight(strings.TrimSpace(b.String()), "; ")
+}
+
+// writeStatements statement types that modify data or schema
+var writeStatements = map[string]bool{
+	"INSERT": true, "UPDATE": true, "DELETE": true, "COPY": true, "DROP": true, "ALTER": true,
+	"TRUNCATE": true, "CREATE": true, "RENAME": true, "OPTIMIZE": true,
+}
+
+// StatementType the leading keyword of a statement upper cased, e.g. SELECT or INSERT
+func StatementType(query string) string {
+	for _, t := range Tokenize(query) {
+		if t.Kind == Word {
+			return strings.ToUpper(t.Text)
+		}
+		if t.Text != "(" {
+			return ""
+		}
+	}
+	return ""
+}
+
+// Statements split a query into its statements on the semicolons between them, statements that are empty or
+// only hold comments are dropped
+func Statements(query string) []string {
+	var statements []string
+	start, tokens := 0, 0
+	for _, t := range append(Tokenize(query), Token{Kind: Symbol, Text: ";", Pos: len(query), End: len(query)}) {
+		if t.Kind != Symbol || t.Text != ";" {
+			tokens++
+			continue
+		}
+		if tokens > 0 {
+			statements = append(statements, strings.TrimSpace(query[start:t.Pos]))
+		}
+		start, tokens = t.End, 0
+	}
+	return statements
+}
+
+// QueryType the type of a statement with a leading WITH clause skipped, e.g. INSERT for
+// WITH s AS (...) INSERT INTO t SELECT * FROM s
+func QueryType(statement string) string {
+	tokens := Tokenize(statement)
+	i := 0
+	for i < len(tokens) && tokens[i].Text == "(" {
+		i++
+	}
+	if i >= len(tokens) || !tokens[i].Is("with") {
+		return StatementType(statement)
+	}
+	i++
+	if i < len(tokens) && tokens[i].Is("recursive") {
+		i++
+	}
+	// name [(columns)] AS (query), ...
+	for i < len(tokens) {
+		i++
+		if i < len(tokens) && tokens[i].Text == "(" {
+			i = closing(tokens, i) + 1
+		}
+		if i < len(tokens) && tokens[i].Is("as") {
+			i++
+		}
+		if i < len(tokens) && tokens[i].Text == "(" {
+			i = closing(tokens, i) + 1
+		}
+		if i >= len(tokens) || tokens[i].Text != "," {
+			break
+		}
+		i++
+	}
+	for ; i < len(tokens); i++ {
+		if tokens[i].Kind == Word {
+			return strings.ToUpper(tokens[i].Text)
+		}
+		if tokens[i].Text != "(" {
+			return ""
+		}
+	}
+	return ""
+}
+
+// IsSelect whether every statement of the query only reads data
+func IsSelect(query string) bool {
+	statements := Statements(query)
+	for _, statement := range statements {
+		if QueryType(statement) != "SELECT" {
+			return false
+		}
+	}
+	return len(statements) > 0
+}
+
+// IsWrite whether any statement of the query modifies data or schema
+func IsWrite(query string) bool {
+	for _, statement := range Statements(query) {
+		if writeStatements[QueryType(statement)] {
+			return true
+		}
+	}
+	return false
+}
+
+// clauseKeywords keywords that end a table reference, so they are never mistaken for an alias
+var clauseKeywords = map[string]bool{
+	"where": true, "join": true, "inner": true, "left": true, "right": true, "full": true, "outer": true,
+	"cross": true, "natural": true, "on": true, "using": true, "group": true, "order": true, "limit": true,
+	"offset": true, "having": true, "union": true, "except": true, "intersect": true, "window": true,
+	"set": true, "values": true, "select": true, "from": true, "with": true, "to": true, "lateral": true, "table": true,
+}
+
+// TableRef a reference to a table in a statement, Start and End index the tokens of the name. Explicit references
+// are queries of the form TABLE name, the TABLE keyword is the token before Start.
+type TableRef struct {
+	Name     string
+	Start    int
+	End      int
+	Alias    string
+	Explicit bool
+}
+
+// Tables the distinct tables a statement reads from or writes to, lower cased
+func Tables(query string) []string {
+	tables, _ := CheckedTables(query)
+	return tables
+}
+
+// fromFunctions functions whose arguments use FROM as a separator rather than to name a table
+var fromFunctions = map[string]bool{
+	"extract": true, "substring": true, "trim": true, "position": true, "overlay": true,
+}
+
+// TableRefs every table reference in the tokens of a statement, including those in subqueries and joins.
+// Names bound by a WITH clause are not tables where they are in scope and are skipped.
+func TableRefs(tokens []Token) []TableRef {
+	refs, _ := tableRefs(tokens)
+	return refs
+}
+
+// CheckedTables the distinct tables a statement reads from or writes to like Tables, false if the statement has a
+// table expression the parser can not follow, e.g. a table function, so that it may reference more tables
+func CheckedTables(query string) ([]string, bool) {
+	refs, ok := tableRefs(Tokenize(query))
+	var tables []string
+	seen := make(map[string]bool)
+	for _, ref := range refs {
+		if !seen[ref.Name] {
+			seen[ref.Name] = true
+			tables = append(tables, ref.Name)
+		}
+	}
+	return tables, ok
+}
+
+// fromEnd keywords that end a FROM clause
+var fromEnd = map[string]bool{
+	"where": true, "group": true, "order": true, "limit": true, "offset": true, "having": true, "union": true,
+	"except": true, "intersect": true, "window": true, "fetch": true,
+}
+
+// level what a pair of parentheses, or the statement itself, holds
+type level struct {
+	// fn the arguments of a function such as extract(... FROM ...)
+	fn bool
+	// from inside a FROM clause, where a comma is followed by another table
+	from bool
+}
+
+// refParser state of finding the table references of a statement
+type refParser struct {
+	tokens []Token
+	ctes   []cte
+	refs   []TableRef
+	// ok whether every table expression could be followed
+	ok bool
+	// next the index of an open parenthesis where a table belongs, a subquery or a parenthesized join
+	next int
+}
+
+func tableRefs(tokens []Token) ([]TableRef, bool) {
+	p := &refParser{tokens: tokens, ctes: withNames(tokens), ok: true, next: -1}
+	stack := []level{{}}
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		top := &stack[len(stack)-1]
+		switch {
+		case t.Text == "(" && t.Kind == Symbol:
+			l := level{fn: i > 0 && fromFunctions[strings.ToLower(tokens[i-1].Text)]}
+			if i == p.next && i+1 < len(tokens) {
+				switch next := tokens[i+1]; {
+				case next.Text == "(" && next.Kind == Symbol:
+					p.next = i + 1
+				case next.Kind == Word && !next.Is("select") && !next.Is("with") && !next.Is("values") && !next.Is("table") ||
+					next.Kind == QuotedIdent:
+					// a parenthesized join
+					l.from = true
+					stack = append(stack, l)
+					i = p.tableRef(i+1, false)
+					continue
+				}
+			}
+			stack = append(stack, l)
+		case t.Text == ")" && t.Kind == Symbol:
+			if len(stack) == 1 {
+				p.ok = false
+				continue
+			}
+			stack = stack[:len(stack)-1]
+		case t.Text == ";" && t.Kind == Symbol:
+			stack = []level{{}}
+		case t.Text == "," && t.Kind == Symbol && top.from:
+			i = p.tableRef(i+1, false)
+		case t.Kind == Word && fromEnd[strings.ToLower(t.Text)]:
+			top.from = false
+		case t.Is("from") && top.fn:
+		case t.Is("from") && i > 0 && tokens[i-1].Is("distinct"):
+			// IS [NOT] DISTINCT FROM
+		case t.Is("from"):
+			top.from = true
+			i = p.tableRef(i+1, false)
+		case t.Is("join"):
+			i = p.tableRef(i+1, false)
+		case t.Is("into"):
+			i = p.tableRef(i+1, true)
+		case t.Is("update") || t.Is("copy") && i == 0:
+			i = p.tableRef(i+1, false)
+		case t.Is("table") && i > 0 && (tokens[i-1].Is("drop") || tokens[i-1].Is("alter") || tokens[i-1].Is("truncate") || tokens[i-1].Is("create")):
+			j := i + 1
+			// IF [NOT] EXISTS
+			for j < len(tokens) && (tokens[j].Is("if") || tokens[j].Is("not") || tokens[j].Is("exists")) {
+				j++
+			}
+			i = p.tableRef(j, false)
+		case t.Is("truncate") && i+1 < len(tokens) && !tokens[i+1].Is("table"):
+			i = p.tableRef(i+1, false)
+		case t.Is("table") && i+1 < len(tokens) && tokens[i+1].Text == "(":
+			// a table function, TABLE(f(...))
+			p.ok = false
+		case t.Is("table"):
+			// an explicit table, TABLE t is a query of every row of t wherever a query may be
+			n := len(p.refs)
+			i = p.tableRef(i+1, false)
+			if len(p.refs) > n {
+				p.refs[n].Explicit = true
+				p.refs[n].Alias = ""
+			}
+		}
+	}
+	if len(stack) > 1 {
+		p.ok = false
+	}
+	return p.refs, p.ok
+}
+
+// tableRef parse the table reference starting at token i, columns allows a column list after the table name as
+// INSERT INTO has. Returns the index of the last token consumed.
+func (p *refParser) tableRef(i int, columns bool) int {
+	tokens := p.tokens
+	if i >= len(tokens) {
+		return i - 1
+	}
+	t := tokens[i]
+	if t.Kind == Symbol && t.Text == "(" {
+		p.next = i
+		return i - 1
+	}
+	if t.Kind != Word && t.Kind != QuotedIdent || t.Kind == Word && clauseKeywords[strings.ToLower(t.Text)] {
+		// a keyword such as LATERAL where a table belongs, a literal such as the file of COPY ... FROM names no
+		// table
+		if t.Kind == Word {
+			p.ok = false
+		}
+		return i - 1
+	}
+	start := i
+	name := t.Ident()
+	for i+2 < len(tokens) && tokens[i+1].Text == "." && (tokens[i+2].Kind == Word || tokens[i+2].Kind == QuotedIdent) {
+		i += 2
+		name = tokens[i].Ident()
+	}
+	// a name followed by a parenthesis is a function call such as unnest(...) unless it is an insert column list
+	if !columns && i+1 < len(tokens) && tokens[i+1].Text == "(" {
+		p.ok = false
+		return i
+	}
+	ref := TableRef{Name: name, Start: start, End: i}
+	i++
+	if i < len(tokens) && tokens[i].Is("as") {
+		i++
+	}
+	if i < len(tokens) && isAlias(tokens[i]) {
+		ref.Alias = tokens[i].Text
+		i++
+	}
+	if !p.isCTE(ref.Name, start) {
+		p.refs = append(p.refs, ref)
+	}
+	return i - 1
+}
+
+// isAlias whether the token can be the alias of a table
+func isAlias(t Token) bool {
+	return t.Kind == Word && !clauseKeywords[strings.ToLower(t.Text)] || t.Kind == QuotedIdent
+}
+
+// cte a name bound by a WITH clause and the range of tokens it is visible in
+type cte struct {
+	name  string
+	start int
+	end   int
+}
+
+func (p *refParser) isCTE(name string, i int) bool {
+	for _, c := range p.ctes {
+		if c.name == name && i >= c.start && i < c.end {
+			return true
+		}
+	}
+	return false
+}
+
+// withNames the names every WITH clause binds. A name is visible from the end of its definition, or in all of it
+// for WITH RECURSIVE, up to the end of the query the WITH clause belongs to.
+func withNames(tokens []Token) []cte {
+	var ctes []cte
+	for w, t := range tokens {
+		if !t.Is("with") {
+			continue
+		}
+		end := queryEnd(tokens, w)
+		j := w + 1
+		recursive := j < len(tokens) && tokens[j].Is("recursive")
+		if recursive {
+			j++
+		}
+		for j < len(tokens) && (tokens[j].Kind == Word || tokens[j].Kind == QuotedIdent) {
+			name := tokens[j].Ident()
+			j++
+			if j < len(tokens) && tokens[j].Text == "(" {
+				j = closing(tokens, j) + 1
+			}
+			if j+1 >= len(tokens) || !tokens[j].Is("as") || tokens[j+1].Text != "(" {
+				break
+			}
+			body := closing(tokens, j+1)
+			start := body
+			if recursive {
+				start = w
+			}
+			ctes = append(ctes, cte{name: name, start: start, end: end})
+			j = body + 1
+			if j >= len(tokens) || tokens[j].Text != "," {
+				break
+			}
+			j++
+		}
+	}
+	return ctes
+}
+
+// closing the index of the parenthesis that closes the one opened at i, the last token if it is never closed
+func closing(tokens []Token, i int) int {
+	depth := 0
+	for j := i; j < len(tokens); j++ {
+		if tokens[j].Kind != Symbol {
+			continue
+		}
+		switch tokens[j].Text {
+		case "(":
+			depth++
+		case ")":
+			if depth--; depth == 0 {
+				return j
+			}
+		}
+	}
+	return len(tokens) - 1
+}
+
+// queryEnd the index just past the query the token at i belongs to: the parenthesis that encloses it or the end
+// of its statement
+func queryEnd(tokens []Token, i int) int {
+	depth := 0
+	for j := i; j < len(tokens); j++ {
+		if tokens[j].Kind != Symbol {
+			continue
+		}
+		switch tokens[j].Text {
+		case "(":
+			depth++
+		case ")":
+			if depth == 0 {
+				return j
+			}
+			depth--
+		case ";":
+			if depth == 0 {
+				return j
+			}
+		}
+	}
+	return len(tokens)
+}
@@ -0,0 +1,92 @@
+package sqlutil
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStatementClass(t *testing.T) {
+	tests := []struct {
+		query     string
+		queryType string
+		isSelect  bool
+		isWrite   bool
+	}{
+		{"SELECT * FROM t", "SELECT", true, false},
+		{"(SELECT 1) UNION (SELECT 2)", "SELECT", true, false},
+		{"WITH s AS (SELECT * FROM t) SELECT * FROM s", "SELECT", true, false},
+		{"WITH RECURSIVE s (n) AS (SELECT 1), u AS (SELECT 2) SELECT * FROM s, u", "SELECT", true, false},
+		{"WITH s AS (SELECT * FROM t) INSERT INTO u SELECT * FROM s", "INSERT", false, true},
+		{"SELECT 1; DROP TABLE t", "SELECT", false, true},
+		{"SELECT 1; SELECT 2;", "SELECT", true, false},
+		{"DELETE FROM t", "DELETE", false, true},
+		{"SHOW TABLES", "SHOW", false, false},
+		{"-- nothing", "", false, false},
+	}
+	for _, test := range tests {
+		if st := QueryType(test.query); st != test.queryType {
+			t.Errorf("QueryType(%q) = %q, want %q", test.query, st, test.queryType)
+		}
+		if IsSelect(test.query) != test.isSelect {
+			t.Errorf("IsSelect(%q) = %v, want %v", test.query, !test.isSelect, test.isSelect)
+		}
+		if IsWrite(test.query) != test.isWrite {
+			t.Errorf("IsWrite(%q) = %v, want %v", test.query, !test.isWrite, test.isWrite)
+		}
+	}
+}
+
+func TestCheckedTables(t *testing.T) {
+	tests := []struct {
+		query  string
+		tables []string
+		ok     bool
+	}{
+		{"SELECT * FROM flights", []string{"flights"}, true},
+		{"SELECT * FROM mapd.flights f JOIN airports a ON f.origin = a.code", []string{"flights", "airports"}, true},
+		{"SELECT * FROM (SELECT 1) x, secret", []string{"secret"}, true},
+		{"SELECT * FROM (SELECT * FROM a) AS x(c), b, (SELECT 1) y, c", []string{"a", "b", "c"}, true},
+		{"SELECT * FROM a JOIN (SELECT * FROM b) x ON 1 = 1, c", []string{"a", "b", "c"}, true},
+		{"SELECT * FROM a LEFT JOIN b USING (x), c", []string{"a", "b", "c"}, true},
+		{"SELECT * FROM (a JOIN b ON a.x = b.x), c", []string{"a", "b", "c"}, true},
+		{"SELECT * FROM ((a JOIN b ON a.x = b.x) JOIN c ON 1 = 1)", []string{"a", "b", "c"}, true},
+		{"SELECT a, b FROM t WHERE x IN (1, 2) GROUP BY a, b", []string{"t"}, true},
+		{"SELECT * FROM a WHERE x IN (WITH secret AS (SELECT 1) SELECT * FROM secret)", []string{"a"}, true},
+		{"SELECT * FROM secret WHERE x IN (WITH secret AS (SELECT 1) SELECT * FROM secret)", []string{"secret"}, true},
+		{"WITH secret AS (SELECT * FROM secret) SELECT * FROM secret", []string{"secret"}, true},
+		{"WITH s AS (SELECT * FROM a), t AS (SELECT * FROM s) SELECT * FROM t, b", []string{"a", "b"}, true},
+		{"WITH RECURSIVE r AS (SELECT 1 UNION SELECT * FROM r) SELECT * FROM r", nil, true},
+		{"SELECT 1; SELECT * FROM s; WITH s AS (SELECT 1) SELECT * FROM s", []string{"s"}, true},
+		{"SELECT extract(year FROM d), substring(s FROM 2) FROM a", []string{"a"}, true},
+		{"SELECT * FROM a WHERE x IS DISTINCT FROM y", []string{"a"}, true},
+		{"INSERT INTO a (x) SELECT x FROM b", []string{"a", "b"}, true},
+		{"UPDATE a SET x = 1", []string{"a"}, true},
+		{"DROP TABLE IF EXISTS a", []string{"a"}, true},
+		{"COPY a FROM '/tmp/a.csv'", []string{"a"}, true},
+		{"TABLE secret", []string{"secret"}, true},
+		{"SELECT * FROM (TABLE secret)", []string{"secret"}, true},
+		{"SELECT * FROM (TABLE secret) AS s, b", []string{"secret", "b"}, true},
+		{"SELECT * FROM pub WHERE x IN (TABLE secret)", []string{"pub", "secret"}, true},
+		{"SELECT * FROM pub WHERE EXISTS (TABLE secret)", []string{"pub", "secret"}, true},
+		{"SELECT (TABLE secret) FROM pub", []string{"secret", "pub"}, true},
+		{"SELECT * FROM pub UNION TABLE secret", []string{"pub", "secret"}, true},
+		{"WITH s AS (TABLE secret) SELECT * FROM s", []string{"secret"}, true},
+		{"WITH secret AS (SELECT 1) TABLE secret", nil, true},
+		{"INSERT INTO a TABLE b", []string{"a", "b"}, true},
+		{"SELECT * FROM TABLE(unnest(x))", nil, false},
+		{`SELECT * FROM U&"secre\0074"`, []string{"secret"}, true},
+		{`SELECT * FROM pub WHERE x IN (SELECT x FROM u&"s\+000065cret")`, []string{"pub", "secret"}, true},
+		{`SELECT * FROM U&"secre!0074" UESCAPE '!'`, []string{"secret"}, true},
+		{`SELECT * FROM U&"secre\0074" UESCAPE '!'`, []string{`secre\0074`}, true},
+		{`SELECT * FROM pub WHERE x IN (TABLE U&"\0073ecret")`, []string{"pub", "secret"}, true},
+		{"SELECT * FROM unnest(x) u, secret", []string{"secret"}, false},
+		{"SELECT * FROM LATERAL (SELECT 1) x", nil, false},
+		{"SELECT * FROM (SELECT * FROM a", []string{"a"}, false},
+	}
+	for _, test := range tests {
+		tables, ok := CheckedTables(test.query)
+		if !reflect.DeepEqual(tables, test.tables) || ok != test.ok {
+			t.Errorf("CheckedTables(%q) = %v, %v, want %v, %v", test.query, tables, ok, test.tables, test.ok)
+		}
+	}
+}
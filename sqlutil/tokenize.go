@@ -0,0 +1,216 @@
+package sqlutil
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// TokenKind the lexical class of a token
+type TokenKind int
+
+const (
+	// Word a keyword or an unquoted identifier
+	Word TokenKind = iota
+	// QuotedIdent a double quoted identifier
+	QuotedIdent
+	// String a single quoted string literal
+	String
+	// Number a numeric literal
+	Number
+	// Symbol an operator or punctuation
+	Symbol
+)
+
+// Token a lexical token of a sql statement, Pos and End are byte offsets into the statement
+type Token struct {
+	Kind TokenKind
+	Text string
+	Pos  int
+	End  int
+}
+
+// Is whether the token is the keyword, case insensitive
+func (t Token) Is(keyword string) bool {
+	return t.Kind == Word && strings.EqualFold(t.Text, keyword)
+}
+
+// Ident the identifier the token names, lower cased unless quoted. The escapes of a unicode identifier such as
+// U&"d\0061ta" are decoded.
+func (t Token) Ident() string {
+	if t.Kind != QuotedIdent {
+		return strings.ToLower(t.Text)
+	}
+	if t.Text[0] == '"' {
+		return unquote(t.Text)
+	}
+	// U&"..." [UESCAPE 'c']
+	end := skipQuoted(t.Text, 2)
+	ident := unquote(t.Text[2:end])
+	escape := byte('\\')
+	if rest := t.Text[end:]; strings.HasSuffix(rest, "'") {
+		if c := strings.Replace(rest[strings.Index(rest, "'")+1:len(rest)-1], "''", "'", -1); len(c) == 1 {
+			escape = c[0]
+		}
+	}
+	return unescapeUnicode(ident, escape)
+}
+
+// unquote a double quoted identifier without its quotes, doubled quotes are escapes
+func unquote(s string) string {
+	s = s[1:]
+	if strings.HasSuffix(s, `"`) {
+		s = s[:len(s)-1]
+	}
+	return strings.Replace(s, `""`, `"`, -1)
+}
+
+// unescapeUnicode decode the escapes of a unicode identifier: the escape character followed by four hex digits,
+// by + and six hex digits or by itself. Invalid escapes are kept as they are, calcite rejects them.
+func unescapeUnicode(s string, escape byte) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != escape || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		if s[i+1] == escape {
+			b.WriteByte(escape)
+			i++
+			continue
+		}
+		digits, start := 4, i+1
+		if s[i+1] == '+' {
+			digits, start = 6, i+2
+		}
+		if start+digits > len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		r, err := strconv.ParseUint(s[start:start+digits], 16, 32)
+		if err != nil {
+			b.WriteByte(s[i])
+			continue
+		}
+		b.WriteRune(rune(r))
+		i = start + digits - 1
+	}
+	return b.String()
+}
+
+// Tokenize split a sql statement into tokens, whitespace and comments are dropped
+func Tokenize(query string) []Token {
+	var tokens []Token
+	i := 0
+	for i < len(query) {
+		c := query[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			i++
+			continue
+		case strings.HasPrefix(query[i:], "--") || strings.HasPrefix(query[i:], "//"):
+			// calcite reads both as comments to the end of the line
+			for i < len(query) && query[i] != '\n' && query[i] != '\r' {
+				i++
+			}
+			continue
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 4
+			}
+			continue
+		case (c == 'u' || c == 'U') && i+2 < len(query) && query[i+1] == '&' &&
+			(query[i+2] == '\'' || query[i+2] == '"'):
+			// a unicode literal or identifier, U&'...' or U&"...", with its UESCAPE clause if it has one
+			i = skipUnicodeEscape(query, skipQuoted(query, i+2))
+			kind := String
+			if query[start+2] == '"' {
+				kind = QuotedIdent
+			}
+			tokens = append(tokens, Token{Kind: kind, Text: query[start:i], Pos: start, End: i})
+			continue
+		case c == '\'' || c == '"':
+			i = skipQuoted(query, i)
+			kind := String
+			if c == '"' {
+				kind = QuotedIdent
+			}
+			tokens = append(tokens, Token{Kind: kind, Text: query[start:i], Pos: start, End: i})
+			continue
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9':
+			for i < len(query) && (isDigit(query[i]) || query[i] == '.' ||
+				(query[i] == 'e' || query[i] == 'E') && i+1 < len(query) && (isDigit(query[i+1]) || query[i+1] == '-' || query[i+1] == '+') ||
+				(query[i] == '-' || query[i] == '+') && (query[i-1] == 'e' || query[i-1] == 'E')) {
+				i++
+			}
+			tokens = append(tokens, Token{Kind: Number, Text: query[start:i], Pos: start, End: i})
+			continue
+		case isWordStart(rune(c)) || c >= 0x80:
+			for i < len(query) && (isWordPart(rune(query[i])) || query[i] >= 0x80) {
+				i++
+			}
+			tokens = append(tokens, Token{Kind: Word, Text: query[start:i], Pos: start, End: i})
+			continue
+		}
+		i++
+		// keep multi character operators together
+		if i < len(query) && strings.Contains("<>!=|:", string(c)) && strings.Contains("<>=|:", string(query[i])) {
+			i++
+		}
+		tokens = append(tokens, Token{Kind: Symbol, Text: query[start:i], Pos: start, End: i})
+	}
+	return tokens
+}
+
+// skipQuoted the offset just past the quoted section starting at i, doubled quotes are escapes
+func skipQuoted(query string, i int) int {
+	quote := query[i]
+	i++
+	for i < len(query) {
+		if query[i] == quote {
+			if i+1 < len(query) && query[i+1] == quote {
+				i += 2
+				continue
+			}
+			return i + 1
+		}
+		i++
+	}
+	return i
+}
+
+// skipUnicodeEscape the offset just past a UESCAPE 'c' clause at i, i if there is none
+func skipUnicodeEscape(query string, i int) int {
+	j := i
+	for j < len(query) && strings.IndexByte(" \t\n\r\f", query[j]) >= 0 {
+		j++
+	}
+	if j+len("uescape") >= len(query) || !strings.EqualFold(query[j:j+len("uescape")], "uescape") {
+		return i
+	}
+	j += len("uescape")
+	for j < len(query) && strings.IndexByte(" \t\n\r\f", query[j]) >= 0 {
+		j++
+	}
+	if j >= len(query) || query[j] != '\'' {
+		return i
+	}
+	return skipQuoted(query, j)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isWordStart(c rune) bool {
+	return c == '_' || unicode.IsLetter(c)
+}
+
+func isWordPart(c rune) bool {
+	return c == '_' || c == '$' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
@@ -0,0 +1,111 @@
+package sqlutil
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		query  string
+		tokens []string
+	}{
+		{"SELECT a FROM t -- , secret", []string{"SELECT", "a", "FROM", "t"}},
+		{"SELECT a FROM t // , secret", []string{"SELECT", "a", "FROM", "t"}},
+		{"SELECT a FROM t // '\n, secret -- '", []string{"SELECT", "a", "FROM", "t", ",", "secret"}},
+		{"SELECT a FROM t -- '\r, secret", []string{"SELECT", "a", "FROM", "t", ",", "secret"}},
+		{"SELECT a /* , secret */ FROM t", []string{"SELECT", "a", "FROM", "t"}},
+		{"SELECT a /* -- */ FROM t", []string{"SELECT", "a", "FROM", "t"}},
+		{"SELECT a FROM t /* , secret", []string{"SELECT", "a", "FROM", "t"}},
+		{"SELECT a/*x*/FROM t", []string{"SELECT", "a", "FROM", "t"}},
+		{"SELECT 6 / 2 FROM t", []string{"SELECT", "6", "/", "2", "FROM", "t"}},
+		{"SELECT '-- x', '// y', '/* z' FROM t", []string{"SELECT", "'-- x'", ",", "'// y'", ",", "'/* z'", "FROM", "t"}},
+		{"SELECT 'it''s' FROM t", []string{"SELECT", "'it''s'", "FROM", "t"}},
+		{"SELECT 'open FROM t", []string{"SELECT", "'open FROM t"}},
+		{`SELECT "a ""b"" -- c" FROM "T"`, []string{"SELECT", `"a ""b"" -- c"`, "FROM", `"T"`}},
+		{"SELECT a$1, _b FROM t", []string{"SELECT", "a$1", ",", "_b", "FROM", "t"}},
+		{`SELECT U&'\0041' FROM U&"t\0041" UESCAPE '\'`, []string{"SELECT", `U&'\0041'`, "FROM", `U&"t\0041" UESCAPE '\'`}},
+		{`SELECT a FROM u&"t" uescape`, []string{"SELECT", "a", "FROM", `u&"t"`, "uescape"}},
+		{"SELECT u & 1 FROM t", []string{"SELECT", "u", "&", "1", "FROM", "t"}},
+		{"SELECT 1.5e-3, .5 FROM t", []string{"SELECT", "1.5e-3", ",", ".5", "FROM", "t"}},
+		{"SELECT a FROM t WHERE b <> 1 OR c::INT >= 2 OR d || e", []string{"SELECT", "a", "FROM", "t", "WHERE", "b", "<>", "1", "OR", "c", "::", "INT", ">=", "2", "OR", "d", "||", "e"}},
+	}
+	for _, test := range tests {
+		var texts []string
+		for _, token := range Tokenize(test.query) {
+			if token.Text != test.query[token.Pos:token.End] {
+				t.Errorf("Tokenize(%q): token %q at %d:%d", test.query, token.Text, token.Pos, token.End)
+			}
+			texts = append(texts, token.Text)
+		}
+		if !reflect.DeepEqual(texts, test.tokens) {
+			t.Errorf("Tokenize(%q) = %q, want %q", test.query, texts, test.tokens)
+		}
+	}
+}
+
+func TestIdent(t *testing.T) {
+	tests := []struct {
+		query string
+		ident string
+	}{
+		{"Flights", "flights"},
+		{`"Flights"`, "Flights"},
+		{`"a ""b"""`, `a "b"`},
+		{`""`, ""},
+		{`"`, ""},
+		{`U&"secre\0074"`, "secret"},
+		{`u&"\+01F600 \\"`, "\U0001F600 \\"},
+		{`U&"a!0062\0063" UESCAPE '!'`, `ab\0063`},
+		{`U&"a!!" UESCAPE '!'`, "a!"},
+		{`U&"bad\00zz\12"`, `bad\00zz\12`},
+	}
+	for _, test := range tests {
+		tokens := Tokenize(test.query)
+		if len(tokens) != 1 {
+			t.Errorf("Tokenize(%q) = %v, want one token", test.query, tokens)
+			continue
+		}
+		if ident := tokens[0].Ident(); ident != test.ident {
+			t.Errorf("Ident(%q) = %q, want %q", test.query, ident, test.ident)
+		}
+	}
+}
+
+func TestCommentsHideNoTables(t *testing.T) {
+	tests := []struct {
+		query  string
+		tables []string
+	}{
+		{"SELECT * FROM pub // '\n, secret -- '", []string{"pub", "secret"}},
+		{"SELECT * FROM pub -- '\n, secret -- '", []string{"pub", "secret"}},
+		{"SELECT * FROM pub /* ' */, secret -- '", []string{"pub", "secret"}},
+		{"SELECT * FROM pub WHERE a = '// ' AND b IN (SELECT b FROM secret)", []string{"pub", "secret"}},
+		{"SELECT * FROM pub // , secret", []string{"pub"}},
+	}
+	filters := map[string]string{"secret": "owner = 1"}
+	for _, test := range tests {
+		tables, ok := CheckedTables(test.query)
+		if !ok || !reflect.DeepEqual(tables, test.tables) {
+			t.Errorf("CheckedTables(%q) = %q, %v, want %q", test.query, tables, ok, test.tables)
+		}
+		filtered, err := AddRowFilters(test.query, filters)
+		if err != nil {
+			t.Errorf("AddRowFilters(%q): %v", test.query, err)
+			continue
+		}
+		if contains(test.tables, "secret") && !strings.Contains(filtered, "owner = 1") {
+			t.Errorf("AddRowFilters(%q) = %q, secret is not filtered", test.query, filtered)
+		}
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
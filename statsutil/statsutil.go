@@ -0,0 +1,224 @@
+package statsutil
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// maxSamples latencies kept per query and bucket, later requests replace them at random so the samples
+	// stay representative of the whole bucket
+	maxSamples = 256
+	// maxQueries distinct queries tracked per bucket, requests for new queries are dropped once it is full
+	maxQueries = 10000
+)
+
+// Sort orders accepted by Top
+const (
+	ByCount = "count"
+	ByTotal = "total"
+	ByP50   = "p50"
+	ByP95   = "p95"
+	ByMax   = "max"
+)
+
+// QueryStats the aggregate of every request for a query fingerprint in the window
+type QueryStats struct {
+	FingerprintID      string  `json:"fingerprint_id"`
+	Fingerprint        string  `json:"fingerprint"`
+	Count              int     `json:"count"`
+	CacheHitRatio      float64 `json:"cache_hit_ratio"`
+	TotalMs            float64 `json:"total_ms"`
+	P50Ms              float64 `json:"p50_ms"`
+	P95Ms              float64 `json:"p95_ms"`
+	MaxMs              float64 `json:"max_ms"`
+	MapdExecutionAvgMs float64 `json:"mapd_execution_avg_ms"`
+}
+
+type series struct {
+	fingerprint string
+	count       int
+	seen        int
+	hits        int
+	lookups     int
+	totalMs     float64
+	maxMs       float64
+	executions  int
+	executionMs int64
+	samples     []float64
+}
+
+type bucket struct {
+	start   int64
+	queries map[string]*series
+}
+
+// Window a rolling window of per fingerprint request statistics, divided into buckets that are dropped as they
+// age out. Safe for concurrent use.
+type Window struct {
+	mu      sync.Mutex
+	width   time.Duration
+	buckets []bucket
+}
+
+// NewWindow a window covering duration, divided into n buckets
+func NewWindow(duration time.Duration, n int) *Window {
+	if n < 1 {
+		n = 1
+	}
+	width := duration / time.Duration(n)
+	if width <= 0 {
+		width = time.Second
+	}
+	return &Window{width: width, buckets: make([]bucket, n)}
+}
+
+// Duration the span of time the window covers
+func (w *Window) Duration() time.Duration {
+	return w.width * time.Duration(len(w.buckets))
+}
+
+// Record add a request for a query. cache is hit or miss for cacheable queries and empty otherwise,
+// executionMs is the time mapd-core reported or 0 if the request was not answered by mapd-core.
+func (w *Window) Record(id string, fingerprint string, durationMs float64, executionMs int64, cache string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	b := w.current(time.Now())
+	s, ok := b.queries[id]
+	if !ok {
+		if len(b.queries) >= maxQueries {
+			return
+		}
+		s = &series{fingerprint: fingerprint}
+		b.queries[id] = s
+	}
+	s.count++
+	s.totalMs += durationMs
+	if durationMs > s.maxMs {
+		s.maxMs = durationMs
+	}
+	if cache != "" {
+		s.lookups++
+	}
+	if cache == "hit" {
+		s.hits++
+	}
+	if executionMs > 0 {
+		s.executions++
+		s.executionMs += executionMs
+	}
+	s.seen++
+	if len(s.samples) < maxSamples {
+		s.samples = append(s.samples, durationMs)
+	} else if i := rand.Intn(s.seen); i < maxSamples {
+		s.samples[i] = durationMs
+	}
+}
+
+// current the bucket for now, reset if it last held an older slot of the ring
+func (w *Window) current(now time.Time) *bucket {
+	slot := now.UnixNano() / int64(w.width)
+	b := &w.buckets[slot%int64(len(w.buckets))]
+	if b.start != slot || b.queries == nil {
+		b.start = slot
+		b.queries = make(map[string]*series)
+	}
+	return b
+}
+
+// Top the n queries in the window with the highest value of the sort order, all queries if n is 0
+func (w *Window) Top(n int, by string) []QueryStats {
+	merged := make(map[string]*series)
+	samples := make(map[string][]float64)
+
+	w.mu.Lock()
+	oldest := time.Now().UnixNano()/int64(w.width) - int64(len(w.buckets)) + 1
+	for _, b := range w.buckets {
+		if b.queries == nil || b.start < oldest {
+			continue
+		}
+		for id, s := range b.queries {
+			m, ok := merged[id]
+			if !ok {
+				m = &series{fingerprint: s.fingerprint}
+				merged[id] = m
+			}
+			m.count += s.count
+			m.hits += s.hits
+			m.lookups += s.lookups
+			m.totalMs += s.totalMs
+			m.maxMs = math.Max(m.maxMs, s.maxMs)
+			m.executions += s.executions
+			m.executionMs += s.executionMs
+			samples[id] = append(samples[id], s.samples...)
+		}
+	}
+	w.mu.Unlock()
+
+	stats := make([]QueryStats, 0, len(merged))
+	for id, m := range merged {
+		q := QueryStats{FingerprintID: id, Fingerprint: m.fingerprint, Count: m.count, TotalMs: m.totalMs, MaxMs: m.maxMs}
+		if m.lookups > 0 {
+			q.CacheHitRatio = float64(m.hits) / float64(m.lookups)
+		}
+		if m.executions > 0 {
+			q.MapdExecutionAvgMs = float64(m.executionMs) / float64(m.executions)
+		}
+		s := samples[id]
+		sort.Float64s(s)
+		q.P50Ms = percentile(s, 0.5)
+		q.P95Ms = percentile(s, 0.95)
+		stats = append(stats, q)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		a, b := value(stats[i], by), value(stats[j], by)
+		if a != b {
+			return a > b
+		}
+		return stats[i].FingerprintID < stats[j].FingerprintID
+	})
+	if n > 0 && len(stats) > n {
+		stats = stats[:n]
+	}
+	return stats
+}
+
+// ValidSort whether Top accepts the sort order
+func ValidSort(by string) bool {
+	switch by {
+	case ByCount, ByTotal, ByP50, ByP95, ByMax:
+		return true
+	}
+	return false
+}
+
+func value(q QueryStats, by string) float64 {
+	switch by {
+	case ByTotal:
+		return q.TotalMs
+	case ByP50:
+		return q.P50Ms
+	case ByP95:
+		return q.P95Ms
+	case ByMax:
+		return q.MaxMs
+	}
+	return float64(q.Count)
+}
+
+// percentile nearest rank percentile of sorted samples
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
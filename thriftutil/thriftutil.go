@@ -0,0 +1,387 @@
+package thriftutil
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/shusson/mapd-api/thrift/e745367/mapd"
+)
+
+// ErrUnknownMethod returned when a request calls a method that is not part of the mapd thrift service
+var ErrUnknownMethod = errors.New("unknown mapd thrift method")
+
+// Struct a generated thrift struct that can be read from and written to a protocol
+type Struct interface {
+	Read(iprot thrift.TProtocol) error
+	Write(oprot thrift.TProtocol) error
+}
+
+// Request a decoded thrift call to the mapd service
+type Request struct {
+	Method string
+	Type   thrift.TMessageType
+	SeqID  int32
+	Args   Struct
+}
+
+// Response a decoded reply from the mapd service
+type Response struct {
+	Method string
+	Type   thrift.TMessageType
+	SeqID  int32
+	Result Struct
+}
+
+// method constructors for the argument and result structs of a mapd thrift method
+type method struct {
+	args   func() Struct
+	result func() Struct
+}
+
+// methods every method in the mapd.MapD interface
+var methods = map[string]method{
+	"connect":                   {func() Struct { return mapd.NewMapDConnectArgs() }, func() Struct { return mapd.NewMapDConnectResult() }},
+	"disconnect":                {func() Struct { return mapd.NewMapDDisconnectArgs() }, func() Struct { return mapd.NewMapDDisconnectResult() }},
+	"get_server_status":         {func() Struct { return mapd.NewMapDGetServerStatusArgs() }, func() Struct { return mapd.NewMapDGetServerStatusResult() }},
+	"get_tables":                {func() Struct { return mapd.NewMapDGetTablesArgs() }, func() Struct { return mapd.NewMapDGetTablesResult() }},
+	"get_table_details":         {func() Struct { return mapd.NewMapDGetTableDetailsArgs() }, func() Struct { return mapd.NewMapDGetTableDetailsResult() }},
+	"get_users":                 {func() Struct { return mapd.NewMapDGetUsersArgs() }, func() Struct { return mapd.NewMapDGetUsersResult() }},
+	"get_databases":             {func() Struct { return mapd.NewMapDGetDatabasesArgs() }, func() Struct { return mapd.NewMapDGetDatabasesResult() }},
+	"get_version":               {func() Struct { return mapd.NewMapDGetVersionArgs() }, func() Struct { return mapd.NewMapDGetVersionResult() }},
+	"start_heap_profile":        {func() Struct { return mapd.NewMapDStartHeapProfileArgs() }, func() Struct { return mapd.NewMapDStartHeapProfileResult() }},
+	"stop_heap_profile":         {func() Struct { return mapd.NewMapDStopHeapProfileArgs() }, func() Struct { return mapd.NewMapDStopHeapProfileResult() }},
+	"get_heap_profile":          {func() Struct { return mapd.NewMapDGetHeapProfileArgs() }, func() Struct { return mapd.NewMapDGetHeapProfileResult() }},
+	"get_memory_gpu":            {func() Struct { return mapd.NewMapDGetMemoryGpuArgs() }, func() Struct { return mapd.NewMapDGetMemoryGpuResult() }},
+	"get_memory_summary":        {func() Struct { return mapd.NewMapDGetMemorySummaryArgs() }, func() Struct { return mapd.NewMapDGetMemorySummaryResult() }},
+	"clear_cpu_memory":          {func() Struct { return mapd.NewMapDClearCPUMemoryArgs() }, func() Struct { return mapd.NewMapDClearCPUMemoryResult() }},
+	"clear_gpu_memory":          {func() Struct { return mapd.NewMapDClearGpuMemoryArgs() }, func() Struct { return mapd.NewMapDClearGpuMemoryResult() }},
+	"sql_execute":               {func() Struct { return mapd.NewMapDSqlExecuteArgs() }, func() Struct { return mapd.NewMapDSqlExecuteResult() }},
+	"sql_execute_df":            {func() Struct { return mapd.NewMapDSqlExecuteDfArgs() }, func() Struct { return mapd.NewMapDSqlExecuteDfResult() }},
+	"sql_execute_gpudf":         {func() Struct { return mapd.NewMapDSqlExecuteGpudfArgs() }, func() Struct { return mapd.NewMapDSqlExecuteGpudfResult() }},
+	"interrupt":                 {func() Struct { return mapd.NewMapDInterruptArgs() }, func() Struct { return mapd.NewMapDInterruptResult() }},
+	"sql_validate":              {func() Struct { return mapd.NewMapDSqlValidateArgs() }, func() Struct { return mapd.NewMapDSqlValidateResult() }},
+	"set_execution_mode":        {func() Struct { return mapd.NewMapDSetExecutionModeArgs() }, func() Struct { return mapd.NewMapDSetExecutionModeResult() }},
+	"render_vega":               {func() Struct { return mapd.NewMapDRenderVegaArgs() }, func() Struct { return mapd.NewMapDRenderVegaResult() }},
+	"get_result_row_for_pixel":  {func() Struct { return mapd.NewMapDGetResultRowForPixelArgs() }, func() Struct { return mapd.NewMapDGetResultRowForPixelResult() }},
+	"get_frontend_view":         {func() Struct { return mapd.NewMapDGetFrontendViewArgs() }, func() Struct { return mapd.NewMapDGetFrontendViewResult() }},
+	"get_frontend_views":        {func() Struct { return mapd.NewMapDGetFrontendViewsArgs() }, func() Struct { return mapd.NewMapDGetFrontendViewsResult() }},
+	"create_frontend_view":      {func() Struct { return mapd.NewMapDCreateFrontendViewArgs() }, func() Struct { return mapd.NewMapDCreateFrontendViewResult() }},
+	"delete_frontend_view":      {func() Struct { return mapd.NewMapDDeleteFrontendViewArgs() }, func() Struct { return mapd.NewMapDDeleteFrontendViewResult() }},
+	"get_link_view":             {func() Struct { return mapd.NewMapDGetLinkViewArgs() }, func() Struct { return mapd.NewMapDGetLinkViewResult() }},
+	"create_link":               {func() Struct { return mapd.NewMapDCreateLinkArgs() }, func() Struct { return mapd.NewMapDCreateLinkResult() }},
+	"load_table_binary":         {func() Struct { return mapd.NewMapDLoadTableBinaryArgs() }, func() Struct { return mapd.NewMapDLoadTableBinaryResult() }},
+	"load_table":                {func() Struct { return mapd.NewMapDLoadTableArgs() }, func() Struct { return mapd.NewMapDLoadTableResult() }},
+	"detect_column_types":       {func() Struct { return mapd.NewMapDDetectColumnTypesArgs() }, func() Struct { return mapd.NewMapDDetectColumnTypesResult() }},
+	"create_table":              {func() Struct { return mapd.NewMapDCreateTableArgs() }, func() Struct { return mapd.NewMapDCreateTableResult() }},
+	"import_table":              {func() Struct { return mapd.NewMapDImportTableArgs() }, func() Struct { return mapd.NewMapDImportTableResult() }},
+	"import_geo_table":          {func() Struct { return mapd.NewMapDImportGeoTableArgs() }, func() Struct { return mapd.NewMapDImportGeoTableResult() }},
+	"import_table_status":       {func() Struct { return mapd.NewMapDImportTableStatusArgs() }, func() Struct { return mapd.NewMapDImportTableStatusResult() }},
+	"start_query":               {func() Struct { return mapd.NewMapDStartQueryArgs() }, func() Struct { return mapd.NewMapDStartQueryResult() }},
+	"execute_first_step":        {func() Struct { return mapd.NewMapDExecuteFirstStepArgs() }, func() Struct { return mapd.NewMapDExecuteFirstStepResult() }},
+	"broadcast_serialized_rows": {func() Struct { return mapd.NewMapDBroadcastSerializedRowsArgs() }, func() Struct { return mapd.NewMapDBroadcastSerializedRowsResult() }},
+	"render_vega_raw_pixels":    {func() Struct { return mapd.NewMapDRenderVegaRawPixelsArgs() }, func() Struct { return mapd.NewMapDRenderVegaRawPixelsResult() }},
+	"insert_data":               {func() Struct { return mapd.NewMapDInsertDataArgs() }, func() Struct { return mapd.NewMapDInsertDataResult() }},
+	"get_table_descriptor":      {func() Struct { return mapd.NewMapDGetTableDescriptorArgs() }, func() Struct { return mapd.NewMapDGetTableDescriptorResult() }},
+	"get_row_descriptor":        {func() Struct { return mapd.NewMapDGetRowDescriptorArgs() }, func() Struct { return mapd.NewMapDGetRowDescriptorResult() }},
+	"render":                    {func() Struct { return mapd.NewMapDRenderArgs() }, func() Struct { return mapd.NewMapDRenderResult() }},
+	"get_rows_for_pixels":       {func() Struct { return mapd.NewMapDGetRowsForPixelsArgs() }, func() Struct { return mapd.NewMapDGetRowsForPixelsResult() }},
+	"get_row_for_pixel":         {func() Struct { return mapd.NewMapDGetRowForPixelArgs() }, func() Struct { return mapd.NewMapDGetRowForPixelResult() }},
+}
+
+// DecodeRequest decode a thrift json encoded call to the mapd service
+func DecodeRequest(body []byte) (*Request, error) {
+	iprot := newProtocol(body)
+	name, typeID, seqID, err := iprot.ReadMessageBegin()
+	if err != nil {
+		return nil, err
+	}
+	m, ok := methods[name]
+	if !ok {
+		return &Request{Method: name, Type: typeID, SeqID: seqID}, ErrUnknownMethod
+	}
+	args := m.args()
+	if err := args.Read(iprot); err != nil {
+		return nil, err
+	}
+	if err := iprot.ReadMessageEnd(); err != nil {
+		return nil, err
+	}
+	return &Request{Method: name, Type: typeID, SeqID: seqID, Args: args}, nil
+}
+
+// DecodeResponse decode a thrift json encoded reply from the mapd service
+func DecodeResponse(body []byte) (*Response, error) {
+	iprot := newProtocol(body)
+	name, typeID, seqID, err := iprot.ReadMessageBegin()
+	if err != nil {
+		return nil, err
+	}
+	if typeID != thrift.REPLY {
+		return nil, fmt.Errorf("%s: unexpected thrift message type %d", name, typeID)
+	}
+	m, ok := methods[name]
+	if !ok {
+		return nil, ErrUnknownMethod
+	}
+	result := m.result()
+	if err := result.Read(iprot); err != nil {
+		return nil, err
+	}
+	if err := iprot.ReadMessageEnd(); err != nil {
+		return nil, err
+	}
+	return &Response{Method: name, Type: typeID, SeqID: seqID, Result: result}, nil
+}
+
+// Encode serialize the response back into thrift json
+func (r *Response) Encode() ([]byte, error) {
+	return encodeMessage(r.Method, r.Type, r.SeqID, r.Result)
+}
+
+// Exception the TMapDException carried by the reply, nil if there is none
+func (r *Response) Exception() *mapd.TMapDException {
+	f := reflect.ValueOf(r.Result).Elem().FieldByName("E")
+	if !f.IsValid() || f.IsNil() {
+		return nil
+	}
+	e, _ := f.Interface().(*mapd.TMapDException)
+	return e
+}
+
+// Succeeded whether the reply carries a result and no exception
+func (r *Response) Succeeded() bool {
+	if r.Exception() != nil {
+		return false
+	}
+	success := reflect.ValueOf(r.Result).Elem().FieldByName("Success")
+	if !success.IsValid() {
+		// methods without a return value
+		return true
+	}
+	switch success.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map:
+		return !success.IsNil()
+	}
+	return true
+}
+
+// SetNonce replace the nonce of a successful result, returns false if the result does not carry one
+func (r *Response) SetNonce(nonce string) bool {
+	success := reflect.ValueOf(r.Result).Elem().FieldByName("Success")
+	if !success.IsValid() || success.Kind() != reflect.Ptr || success.IsNil() || success.Elem().Kind() != reflect.Struct {
+		return false
+	}
+	f := success.Elem().FieldByName("Nonce")
+	if !f.IsValid() || f.Kind() != reflect.String {
+		return false
+	}
+	f.SetString(nonce)
+	return true
+}
+
+// Encode serialize the request back into thrift json
+func (r *Request) Encode() ([]byte, error) {
+	return encodeMessage(r.Method, r.Type, r.SeqID, r.Args)
+}
+
+// HasSession whether the arguments of the request carry a session
+func (r *Request) HasSession() bool {
+	return sessionField(r.Args).IsValid()
+}
+
+// Session the session the request was made with, empty if the method does not take one
+func (r *Request) Session() mapd.TSessionId {
+	f := sessionField(r.Args)
+	if !f.IsValid() {
+		return ""
+	}
+	return mapd.TSessionId(f.String())
+}
+
+// Nonce the nonce the client tagged the request with, empty if the method does not take one
+func (r *Request) Nonce() string {
+	return r.stringArg("Nonce")
+}
+
+// TableName the table the request targets, empty if the method does not name one
+func (r *Request) TableName() string {
+	return r.stringArg("TableName")
+}
+
+// Query the sql statement the request carries, empty if the method does not take one
+func (r *Request) Query() string {
+	return r.stringArg("Query")
+}
+
+// SetQuery replace the sql statement of the request, returns false if the method does not take one
+func (r *Request) SetQuery(query string) bool {
+	return r.setStringArg("Query", query)
+}
+
+// TableColNames the columns of each table a get_result_row_for_pixel request reads, nil for any other method
+func (r *Request) TableColNames() map[string][]string {
+	if args, ok := r.Args.(*mapd.MapDGetResultRowForPixelArgs); ok {
+		return args.TableColNames
+	}
+	return nil
+}
+
+// VegaJSON the vega spec a render request carries, empty if the method does not take one
+func (r *Request) VegaJSON() string {
+	return r.stringArg("VegaJSON")
+}
+
+// SetVegaJSON replace the vega spec of the request, returns false if the method does not take one
+func (r *Request) SetVegaJSON(vega string) bool {
+	return r.setStringArg("VegaJSON", vega)
+}
+
+// VegaQueries the sql of every data source of the vega spec the request carries, an error if the spec can not be
+// read so that sql which can not be found is not mistaken for no sql
+func (r *Request) VegaQueries() ([]string, error) {
+	vega := r.VegaJSON()
+	if vega == "" {
+		return nil, nil
+	}
+	var spec struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(vega), &spec); err != nil {
+		return nil, fmt.Errorf("unreadable vega spec: %s", err.Error())
+	}
+	var queries []string
+	for _, source := range spec.Data {
+		v, ok := source["sql"]
+		if !ok {
+			continue
+		}
+		query, ok := v.(string)
+		if !ok {
+			return nil, errors.New("unreadable vega spec: sql of a data source is not a string")
+		}
+		queries = append(queries, query)
+	}
+	return queries, nil
+}
+
+// stringArg the value of a string field of the args struct, empty if the method has no such field
+func (r *Request) stringArg(name string) string {
+	f := r.stringField(name)
+	if !f.IsValid() {
+		return ""
+	}
+	return f.String()
+}
+
+// setStringArg set a string field of the args struct, false if the method has no such field
+func (r *Request) setStringArg(name string, value string) bool {
+	f := r.stringField(name)
+	if !f.IsValid() {
+		return false
+	}
+	f.SetString(value)
+	return true
+}
+
+func (r *Request) stringField(name string) reflect.Value {
+	if r.Args == nil {
+		return reflect.Value{}
+	}
+	f := reflect.ValueOf(r.Args).Elem().FieldByName(name)
+	if !f.IsValid() || f.Kind() != reflect.String {
+		return reflect.Value{}
+	}
+	return f
+}
+
+// SetSession replace the session of the request, returns false if the method does not take one
+func (r *Request) SetSession(session mapd.TSessionId) bool {
+	f := sessionField(r.Args)
+	if !f.IsValid() {
+		return false
+	}
+	f.SetString(string(session))
+	return true
+}
+
+// sessionField every generated args struct that takes a session names the field Session
+func sessionField(args Struct) reflect.Value {
+	if args == nil {
+		return reflect.Value{}
+	}
+	v := reflect.ValueOf(args)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}
+	}
+	f := v.Elem().FieldByName("Session")
+	if !f.IsValid() || f.Type() != reflect.TypeOf(mapd.TSessionId("")) {
+		return reflect.Value{}
+	}
+	return f
+}
+
+// Methods the names of every method in the mapd.MapD interface
+func Methods() []string {
+	names := make([]string, 0, len(methods))
+	for name := range methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewResult construct an empty result struct for the method
+func NewResult(method string) (Struct, error) {
+	m, ok := methods[method]
+	if !ok {
+		return nil, ErrUnknownMethod
+	}
+	return m.result(), nil
+}
+
+// EncodeReply serialize a reply to the request
+func (r *Request) EncodeReply(result Struct) ([]byte, error) {
+	return encodeMessage(r.Method, thrift.REPLY, r.SeqID, result)
+}
+
+// EncodeException serialize a reply to the request that carries a TMapDException with the message
+func (r *Request) EncodeException(msg string) ([]byte, error) {
+	result, err := NewResult(r.Method)
+	if err != nil {
+		x := thrift.NewTApplicationException(thrift.UNKNOWN_METHOD, msg)
+		return encodeMessage(r.Method, thrift.EXCEPTION, r.SeqID, x)
+	}
+	// every generated result struct names its TMapDException field E
+	reflect.ValueOf(result).Elem().FieldByName("E").Set(reflect.ValueOf(&mapd.TMapDException{ErrorMsg: msg}))
+	return r.EncodeReply(result)
+}
+
+func newProtocol(body []byte) thrift.TProtocol {
+	buf := thrift.NewTMemoryBufferLen(len(body))
+	buf.Write(body)
+	return thrift.NewTJSONProtocol(buf)
+}
+
+func encodeMessage(method string, typeID thrift.TMessageType, seqID int32, s interface {
+	Write(oprot thrift.TProtocol) error
+}) ([]byte, error) {
+	buf := thrift.NewTMemoryBuffer()
+	oprot := thrift.NewTJSONProtocol(buf)
+	if err := oprot.WriteMessageBegin(method, typeID, seqID); err != nil {
+		return nil, err
+	}
+	if err := s.Write(oprot); err != nil {
+		return nil, err
+	}
+	if err := oprot.WriteMessageEnd(); err != nil {
+		return nil, err
+	}
+	if err := oprot.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,170 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Client certificate modes of the listener
+const (
+	// NoClientCert client certificates are not requested
+	NoClientCert = "none"
+	// VerifyClientCertIfGiven a client certificate is optional but verified when one is sent
+	VerifyClientCertIfGiven = "verify-if-given"
+	// RequireClientCert every client must present a certificate signed by the client ca
+	RequireClientCert = "require"
+)
+
+// CertReloader serves a certificate and key pair from files and reloads them when they change, so that
+// certificates can be rotated without a restart
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewCertReloader load the certificate and key pair
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate the current certificate, for use as tls.Config.GetCertificate
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Watch check the files for changes every interval until stop is closed. A pair that fails to load is logged
+// and the current certificate is kept.
+func (r *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			modTime, err := r.latestModTime()
+			if err != nil {
+				log.Println("failed to check tls certificate: " + err.Error())
+				continue
+			}
+			r.mu.RLock()
+			changed := modTime.After(r.modTime)
+			r.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := r.reload(); err != nil {
+				log.Println("failed to reload tls certificate, keeping the current one: " + err.Error())
+				continue
+			}
+			log.Println("reloaded tls certificate: ", r.certFile)
+		}
+	}
+}
+
+func (r *CertReloader) reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+	return nil
+}
+
+// latestModTime the most recent modification time of the certificate and key files
+func (r *CertReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// ServerConfig the tls config of the listener. With a client ca, client certificates are verified against it
+// as set by clientAuth.
+func ServerConfig(certs *CertReloader, clientCAFile string, clientAuth string) (*tls.Config, error) {
+	config := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	switch clientAuth {
+	case NoClientCert, "":
+		return config, nil
+	case VerifyClientCertIfGiven:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case RequireClientCert:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client certificate mode %q", clientAuth)
+	}
+	pool, err := CertPool(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = pool
+	return config, nil
+}
+
+// ClientConfig the tls config of connections to an upstream server. The server certificate is verified against
+// caFile or the system roots if empty, certFile and keyFile are presented as the client certificate if given and
+// serverName overrides the name the server certificate is checked against.
+func ClientConfig(caFile string, certFile string, keyFile string, serverName string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := CertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// CertPool read a pem bundle of ca certificates
+func CertPool(caFile string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}